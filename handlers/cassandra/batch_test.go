@@ -0,0 +1,113 @@
+package cassandra
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/gocql/gocql"
+)
+
+func TestSplitBatch(t *testing.T) {
+	item := func(size int) CassandraSet {
+		// itemBytes adds 16 bytes of overhead to the key and value
+		return CassandraSet{Key: []byte("k"), Data: bytes.Repeat([]byte("x"), size-17)}
+	}
+
+	t.Run("NoLimit", func(t *testing.T) {
+		jobs := splitBatch(batchJob{items: []CassandraSet{item(100), item(1000)}}, 0)
+		if len(jobs) != 1 || len(jobs[0].items) != 2 {
+			t.Fatalf("Expected a single batch of 2 items, got %d batches", len(jobs))
+		}
+	})
+
+	t.Run("Split", func(t *testing.T) {
+		jobs := splitBatch(batchJob{items: []CassandraSet{item(40), item(40), item(40), item(90)}}, 100)
+		sizes := []int{2, 1, 1}
+		if len(jobs) != len(sizes) {
+			t.Fatalf("Expected %d batches, got %d", len(sizes), len(jobs))
+		}
+		for i, n := range sizes {
+			if len(jobs[i].items) != n {
+				t.Fatalf("Expected batch %d to hold %d items, got %d", i, n, len(jobs[i].items))
+			}
+		}
+	})
+
+	t.Run("Oversized", func(t *testing.T) {
+		jobs := splitBatch(batchJob{items: []CassandraSet{item(40), item(500), item(40)}}, 100)
+		if len(jobs) != 3 || len(jobs[1].items) != 1 || len(jobs[1].items[0].Data) != 483 {
+			t.Fatalf("Expected oversized item to be alone in its batch, got %d batches", len(jobs))
+		}
+	})
+}
+
+func TestCoalesce(t *testing.T) {
+	done1 := make(chan error, 1)
+	done2 := make(chan error, 1)
+	items, dropped := coalesce([]CassandraSet{
+		{Key: []byte("key1"), Data: []byte("foo"), seq: 1, done: done1},
+		{Key: []byte("key2"), Data: []byte("bar"), seq: 2},
+		{Key: []byte("key1"), Data: []byte("baz"), seq: 4},
+		{Key: []byte("key1"), Data: []byte("qux"), seq: 3, done: done2},
+	})
+
+	if len(items) != 2 || len(dropped) != 2 {
+		t.Fatalf("Expected 2 items kept and 2 dropped after coalescing, got %d and %d", len(items), len(dropped))
+	}
+	if string(items[0].Key) != "key1" || string(items[0].Data) != "baz" {
+		t.Fatalf("Expected newest write of key1 to be kept, got %q", items[0].Data)
+	}
+	if string(items[1].Key) != "key2" || string(items[1].Data) != "bar" {
+		t.Fatalf("Expected key2 write to be kept, got %q", items[1].Data)
+	}
+	if len(items[0].coalesced) != 2 {
+		t.Fatalf("Expected 2 coalesced writers to be notified with key1 write, got %d", len(items[0].coalesced))
+	}
+}
+
+func TestCoalesceDeletes(t *testing.T) {
+	items, _ := coalesce([]CassandraSet{
+		{Key: []byte("key1"), Data: []byte("foo"), seq: 1},
+		{Key: []byte("key1"), Deleted: true, seq: 2},
+		{Key: []byte("key2"), Deleted: true, seq: 3},
+		{Key: []byte("key2"), Data: []byte("bar"), seq: 4},
+	})
+
+	if len(items) != 2 {
+		t.Fatalf("Expected 2 items kept after coalescing, got %d", len(items))
+	}
+	if !items[0].Deleted {
+		t.Fatalf("Expected deletion of key1 to supersede its older set")
+	}
+	if items[1].Deleted || string(items[1].Data) != "bar" {
+		t.Fatalf("Expected set of key2 to supersede its older deletion")
+	}
+}
+
+func TestBatchQueries(t *testing.T) {
+	for _, flagscol := range []bool{true, false} {
+		h := &Handler{flagscol: flagscol, stmts: buildStatements("kvstore", "bucket", flagscol)}
+		b := gocql.NewBatch(gocql.UnloggedBatch)
+		h.batchQueries(b, []CassandraSet{
+			{Key: []byte("key1"), Data: []byte("foo"), Flags: 3, Exptime: 60, seq: 1},
+			{Key: []byte("key2"), Deleted: true, seq: 2},
+		})
+
+		if len(b.Entries) != 2 {
+			t.Fatalf("Expected 2 batch entries, got %d", len(b.Entries))
+		}
+		for i, entry := range b.Entries {
+			// Every bind marker of the statement gets its own value
+			if markers := strings.Count(entry.Stmt, "?"); len(entry.Args) != markers {
+				t.Fatalf("Expected %d values for entry %d (flagscol %v), got %d : %#v", markers, i, flagscol, len(entry.Args), entry.Args)
+			}
+		}
+		if entry := b.Entries[0]; entry.Stmt != h.stmts.insert || entry.Args[len(entry.Args)-1] != int64(1) {
+			t.Fatalf("Expected set to be inserted with its own timestamp, got %q %#v", entry.Stmt, entry.Args)
+		}
+		if entry := b.Entries[1]; entry.Stmt != h.stmts.delete || entry.Args[0] != int64(2) {
+			t.Fatalf("Expected deletion to be timestamped with its sequence number, got %q %#v", entry.Stmt, entry.Args)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package cassandra
 import (
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gocql/gocql"
@@ -16,15 +18,55 @@ import (
 type Handler struct {
 	session      *gocql.Session
 	setbuffer    chan CassandraSet
-	buffertimer  *time.Timer
-	readonlymode bool
+	slots        chan struct{} // one per item in the set buffer, reserved before indexing the item
+	shedpercent  int           // buffer fill percentage from which sets are rejected, 0 to disable
+	buftimeout   time.Duration // longest wait for room in a full buffer, 0 to wait forever
+	flushreq     chan chan struct{}
+	batches      chan batchJob
+	inflight     int64
+	requests     int64 // write requests in flight, waited for on drain
+	unwritten    int64 // items buffered and not written yet
+	deletes      int64 // deletions buffered and not written yet
+	router       *batchRouter
+	tokenaware   bool
+	readonlymode int32 // set atomically, 1 once writes are refused
+	closing      int32 // set atomically, 1 once deletes are refused too before closing the session
+	flagscol     bool
+	syncwrites   bool
+	lwtreplace   bool
+	lwtdelete    bool
+	bufdeletes   bool
+	missonerror  bool
+	getlimit     int           // most keys of a multi-get read at once
+	commitwait   time.Duration // longest wait for a buffered write to reach Cassandra
+	stmts        statements
+	pending      *pendingIndex
+	deadletter   DeadLetterFunc
+	wal          *wal
+	spill        *spillQueue
 }
 
+// CassandraSet is a write buffered until it's flushed in a batch : a set, or a deletion with buffered deletes.
 type CassandraSet struct {
 	Key     []byte
 	Data    []byte
 	Flags   uint32
 	Exptime uint32
+	Deleted bool       // buffered deletion of the key, without data
+	seq     uint64     // pending index sequence number
+	done    chan error // receives the batch result in synchronous write mode
+
+	coalesced []chan error // done channels of the older writes of the key this item superseded
+
+	buffered time.Time // time the item entered the set buffer
+	walseg   uint64    // WAL segment logging the item, 0 if not logged
+}
+
+// batchJob is a batch of items waiting for a batch writer
+type batchJob struct {
+	items []CassandraSet
+	owner *gocql.HostInfo // replica owning all items, nil if unknown
+	wg    *sync.WaitGroup // notified once written, if not nil
 }
 
 // Cassandra Batching metrics
@@ -35,68 +77,409 @@ var (
 	MetricCmdSetBatchSuccess = metrics.AddCounter("cmd_set_batch_success", nil)
 	HistSetBatch             = metrics.AddHistogram("set_batch", false, nil)
 	HistSetBufferWait        = metrics.AddHistogram("set_batch_buffer_timewait", false, nil)
+
+	// Batch writers pool
+	MetricSetBatchInFlight   = metrics.AddIntGauge("cmd_set_batch_in_flight", nil)
+	MetricSetBatchQueueDepth = metrics.AddIntGauge("cmd_set_batch_queue_depth", nil)
+
+	// Token aware batching
+	HistSetBatchSize     = metrics.AddHistogram("set_batch_size", false, nil)
+	HistSetBatchReplicas = metrics.AddHistogram("set_batch_replicas", false, nil)
+
+	// Batch payload limit
+	HistSetBatchBytes          = metrics.AddHistogram("set_batch_bytes", false, nil)
+	MetricCmdSetOversizedItems = metrics.AddCounter("cmd_set_oversized_items", nil)
+
+	// Sets rejected on a full (or almost full) set buffer
+	MetricCmdSetBufferRejected = metrics.AddCounter("cmd_set_buffer_rejected", nil)
+
+	// Writes dropped because a newer write of the same key was in the same batch
+	MetricCmdSetCoalesced = metrics.AddCounter("cmd_set_coalesced", nil)
+
+	// Failed batches handling
+	MetricCmdSetBatchRetries      = metrics.AddCounter("cmd_set_batch_retries", nil)
+	MetricCmdSetBatchSplits       = metrics.AddCounter("cmd_set_batch_splits", nil)
+	MetricCmdSetDeadLetterItems   = metrics.AddCounter("cmd_set_dead_letter_items", nil)
+	MetricCmdSetBatchDroppedItems = metrics.AddCounter("cmd_set_batch_dropped_items", nil)
+
+	// Reads served from writes still waiting in the set buffer
+	MetricCmdGetSetBufferHits = metrics.AddCounter("cmd_get_set_buffer_hits", nil)
+
+	// Buffered deletes
+	MetricDeleteBufferSize = metrics.AddIntGauge("cmd_delete_batch_buffer_size", nil)
+	HistDeleteBatch        = metrics.AddHistogram("delete_batch", false, nil)
+
+	// Backend errors answered as misses, in the miss CassandraGetErrorMode
+	MetricCmdGetErrorsAsMisses = metrics.AddCounter("cmd_get_errors_as_misses", nil)
+)
+
+// Get error modes
+const (
+	getErrorModeError = "error" // a backend error fails the whole get
+	getErrorModeMiss  = "miss"  // a backend error is answered as a miss of the key
 )
 
+// casMaxRetries bounds read-modify-write loops racing against concurrent writers of the same key
+const casMaxRetries = 10
+
 var singleton *Handler
 
 // SetReadonlyMode switch Cassandra handler to readonly mode for graceful exit
 func SetReadonlyMode() {
-	singleton.readonlymode = true
+	atomic.StoreInt32(&singleton.readonlymode, 1)
+}
+
+// readonly tells if writes are refused, the handler is being drained
+func (h *Handler) readonly() bool {
+	return atomic.LoadInt32(&h.readonlymode) == 1
 }
 
-func bufferSizeCheckLoop() {
-	ticker := time.NewTicker(5 * time.Millisecond)
+// flushLoop is the only owner of the items pulled out of the set buffer, so an item can never
+// be flushed twice. A batch is queued to the batch writers as soon as it holds CassandraBatchMinItemSize
+// items (completed with the items already waiting in the buffer, up to CassandraBatchMaxItemSize),
+// or when its oldest item has been waiting for CassandraBatchBufferMaxAgeMs. Only the newest write of
+// each key of a batch is kept, and batches are then split so their payload never exceeds CassandraBatchMaxBytes.
+// When all writers are busy and the batch queue is full, the loop waits and items pile up in the set buffer.
+func (h *Handler) flushLoop() {
+	minItems := viper.GetInt("CassandraBatchMinItemSize")
+	maxItems := viper.GetInt("CassandraBatchMaxItemSize")
+	maxAge := viper.GetDuration("CassandraBatchBufferMaxAgeMs")
+	maxBytes := viper.GetInt("CassandraBatchMaxBytes")
+
+	var batch []CassandraSet
+	flush := func(wg *sync.WaitGroup) {
+		if len(batch) > 0 {
+			var dropped []CassandraSet
+			batch, dropped = coalesce(batch)
+			for _, item := range dropped {
+				h.wal.release(item)
+			}
+			h.written(dropped)
+			for _, routed := range h.routeBatch(batch) {
+				for _, job := range splitBatch(routed, maxBytes) {
+					metrics.IncCounter(MetricCmdSetBatch)
+					metrics.ObserveHist(HistSetBatchSize, uint64(len(job.items)))
+					if wg != nil {
+						wg.Add(1)
+					}
+					job.wg = wg
+					h.batches <- job
+					metrics.SetIntGauge(MetricSetBatchQueueDepth, uint64(len(h.batches)))
+				}
+			}
+			batch = nil
+		}
+		metrics.SetIntGauge(MetricSetBufferSize, uint64(len(h.setbuffer)))
+	}
+
+	age := time.NewTimer(maxAge)
+	stopTimer(age)
+
 	for {
 		select {
-		case <-ticker.C:
-			if len(singleton.setbuffer) >= viper.GetInt("CassandraBatchMinItemSize") {
-				go FlushBuffer()
+		case item := <-h.setbuffer:
+			<-h.slots
+			if len(batch) == 0 {
+				age.Reset(maxAge)
+			}
+			batch = append(batch, item)
+			if len(batch) < minItems && len(batch) < maxItems {
+				continue
+			}
+			for full := false; !full && len(batch) < maxItems; {
+				select {
+				case item := <-h.setbuffer:
+					<-h.slots
+					batch = append(batch, item)
+				default:
+					full = true
+				}
 			}
+			stopTimer(age)
+			flush(nil)
+
+		case <-age.C:
+			flush(nil)
+
+		case done := <-h.flushreq:
+			// Write every item buffered until now, in batches of at most CassandraBatchMaxItemSize items
+			stopTimer(age)
+			var wg sync.WaitGroup
+			for n := len(h.setbuffer); n > 0 || len(batch) > 0; {
+				for ; n > 0 && len(batch) < maxItems; n-- {
+					batch = append(batch, <-h.setbuffer)
+					<-h.slots
+				}
+				flush(&wg)
+			}
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
 		}
 	}
 }
 
-// FlushBuffer triggers a batched write operation in Cassandra target
+// batchWriter writes the batches queued by the flush loop, one at a time.
+// CassandraBatchWriters writers run concurrently, bounding the number of batches in flight.
+func (h *Handler) batchWriter() {
+	for job := range h.batches {
+		metrics.SetIntGauge(MetricSetBatchQueueDepth, uint64(len(h.batches)))
+		metrics.SetIntGauge(MetricSetBatchInFlight, uint64(atomic.AddInt64(&h.inflight, 1)))
+
+		h.writeItems(job.items, job.owner)
+
+		metrics.SetIntGauge(MetricSetBatchInFlight, uint64(atomic.AddInt64(&h.inflight, -1)))
+		if job.wg != nil {
+			job.wg.Done()
+		}
+	}
+}
+
+// routeBatch splits a batch by the primary replica owning the key of each item, so each batch
+// is sent to a single replica of all its items instead of being fanned out by the coordinator.
+// The batch is kept whole when the token ring is unknown or token aware batching is disabled.
+func (h *Handler) routeBatch(items []CassandraSet) []batchJob {
+	owners := make([]*gocql.HostInfo, len(items))
+	groups := make(map[*gocql.HostInfo]int) // owner -> index of its batch
+	for i, item := range items {
+		owners[i] = h.router.owner(item.Key)
+		if owners[i] == nil {
+			// Unknown token ring
+			return []batchJob{{items: items}}
+		}
+		groups[owners[i]] = -1
+	}
+
+	if !h.tokenaware || len(groups) == 1 {
+		metrics.ObserveHist(HistSetBatchReplicas, uint64(len(groups)))
+		var owner *gocql.HostInfo
+		if len(groups) == 1 {
+			owner = owners[0]
+		}
+		return []batchJob{{items: items, owner: owner}}
+	}
+
+	jobs := make([]batchJob, 0, len(groups))
+	for i, item := range items {
+		idx := groups[owners[i]]
+		if idx < 0 {
+			idx = len(jobs)
+			groups[owners[i]] = idx
+			jobs = append(jobs, batchJob{owner: owners[i]})
+		}
+		jobs[idx].items = append(jobs[idx].items, item)
+	}
+	for range jobs {
+		metrics.ObserveHist(HistSetBatchReplicas, 1)
+	}
+	return jobs
+}
+
+// coalesce keeps only the newest write of each key of a batch, the last write wins anyway.
+// Synchronous writers of a dropped item are notified along with the write superseding it.
+func coalesce(items []CassandraSet) ([]CassandraSet, []CassandraSet) {
+	latest := make(map[string]int, len(items)) // key -> index of its newest write in out
+	out := make([]CassandraSet, 0, len(items))
+	var dropped []CassandraSet
+	for _, item := range items {
+		idx, ok := latest[string(item.Key)]
+		if !ok {
+			latest[string(item.Key)] = len(out)
+			out = append(out, item)
+			continue
+		}
+
+		metrics.IncCounter(MetricCmdSetCoalesced)
+		older := out[idx]
+		if item.seq < older.seq {
+			older, item = item, older
+		}
+		item.coalesced = append(item.coalesced, older.coalesced...)
+		if older.done != nil {
+			item.coalesced = append(item.coalesced, older.done)
+		}
+		out[idx] = item
+		dropped = append(dropped, older)
+	}
+	return out, dropped
+}
+
+// itemBytes estimates the size of an item in a batch payload : its key and value,
+// plus flags, TTL and timestamp.
+func itemBytes(item CassandraSet) int {
+	return len(item.Key) + len(item.Data) + 16
+}
+
+// splitBatch splits a batch in consecutive batches whose payload doesn't exceed maxBytes.
+// An item bigger than maxBytes on its own gets a batch of its own, which is written as a single query.
+// A maxBytes of 0 disables the limit.
+func splitBatch(job batchJob, maxBytes int) []batchJob {
+	var jobs []batchJob
+	start, size := 0, 0
+	for i, item := range job.items {
+		n := itemBytes(item)
+		if maxBytes > 0 && size+n > maxBytes && i > start {
+			jobs = append(jobs, batchJob{items: job.items[start:i], owner: job.owner})
+			metrics.ObserveHist(HistSetBatchBytes, uint64(size))
+			start, size = i, 0
+		}
+		if maxBytes > 0 && n > maxBytes {
+			metrics.IncCounter(MetricCmdSetOversizedItems)
+		}
+		size += n
+	}
+	if start < len(job.items) {
+		jobs = append(jobs, batchJob{items: job.items[start:], owner: job.owner})
+		metrics.ObserveHist(HistSetBatchBytes, uint64(size))
+	}
+	return jobs
+}
+
+// stopTimer stops a timer and drains its channel if it already fired
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+// FlushBuffer forces every item waiting in the set buffer to be written in Cassandra,
+// and returns once they are.
 func FlushBuffer() {
-	chanLen := len(singleton.setbuffer)
-	metrics.SetIntGauge(MetricSetBufferSize, uint64(chanLen))
-
-	if chanLen > 0 {
-		metrics.IncCounter(MetricCmdSetBatch)
-
-		// fmt.Println(chanLen)
-		if chanLen >= viper.GetInt("CassandraBatchMaxItemSize") {
-			chanLen = viper.GetInt("CassandraBatchMaxItemSize")
-		}
-		b := singleton.session.NewBatch(gocql.UnloggedBatch)
-		for i := 1; i <= chanLen; i++ {
-			item := (<-singleton.setbuffer)
-			b.Query(
-				fmt.Sprintf(
-					"INSERT INTO %s.%s (keycol,valuecol) VALUES (?, ?) USING TTL ?",
-					viper.GetString("CassandraKeyspace"),
-					viper.GetString("CassandraBucket"),
-				),
-				item.Key,
-				item.Data,
-				item.Exptime,
-			)
-		}
-
-		// exec CQL batch
+	done := make(chan struct{})
+	singleton.flushreq <- done
+	<-done
+}
+
+// writeItems writes items in a single batch. A batch rejected for its size is split in two halves
+// written separately. A batch still failing after all retries is spilled to disk if Cassandra is
+// unreachable, or sent to the dead-letter sink.
+// Whatever the result, items are then committed and their synchronous writers notified.
+func (h *Handler) writeItems(items []CassandraSet, owner *gocql.HostInfo) {
+	// While Cassandra is unreachable, batches are spilled to disk right away
+	var err error
+	if h.spill.down() {
+		err = errCassandraDown
+	} else {
+		err = h.executeBatch(items, owner)
+	}
+	if err != nil && isBatchTooLarge(err) && len(items) > 1 {
+		metrics.IncCounter(MetricCmdSetBatchSplits)
+		half := len(items) / 2
+		h.writeItems(items[:half], owner)
+		h.writeItems(items[half:], owner)
+		return
+	}
+
+	// Spilled items are replayed once Cassandra is back
+	var res error
+	if err != nil && !(backendError(err) == common.ErrTempFailure && h.spill.push(items)) {
+		res = backendError(err)
+		h.giveUp(items, err)
+	}
+
+	// Whatever the batch result, reads must now go to Cassandra
+	h.written(items)
+	for _, item := range items {
+		h.pending.commit(item.Key, item.seq)
+		h.wal.release(item)
+		if item.done != nil {
+			item.done <- res
+		}
+		for _, done := range item.coalesced {
+			done <- res
+		}
+	}
+}
+
+// buffered counts an item entering the set buffer
+func (h *Handler) buffered(item CassandraSet) {
+	atomic.AddInt64(&h.unwritten, 1)
+	if item.Deleted {
+		metrics.SetIntGauge(MetricDeleteBufferSize, uint64(atomic.AddInt64(&h.deletes, 1)))
+	}
+}
+
+// written counts items out of the pipeline, whether they were written, spilled, given up or coalesced
+func (h *Handler) written(items []CassandraSet) {
+	atomic.AddInt64(&h.unwritten, -int64(len(items)))
+	deletes := 0
+	for _, item := range items {
+		if item.Deleted {
+			deletes++
+		}
+	}
+	if deletes > 0 {
+		metrics.SetIntGauge(MetricDeleteBufferSize, uint64(atomic.AddInt64(&h.deletes, -int64(deletes))))
+	}
+}
+
+// giveUp sends the items of a failed batch to the dead-letter sink, or drops them if there's none
+func (h *Handler) giveUp(items []CassandraSet, err error) {
+	if h.deadletter != nil {
+		metrics.IncCounterBy(MetricCmdSetDeadLetterItems, uint64(len(items)))
+		h.deadletter(items, err)
+	} else {
+		metrics.IncCounterBy(MetricCmdSetBatchDroppedItems, uint64(len(items)))
+		log.Println("[ERROR] Dropping", len(items), "items of a failed Cassandra batch")
+	}
+}
+
+// batchQueries adds the statement writing each item to a batch
+func (h *Handler) batchQueries(b *gocql.Batch, items []CassandraSet) {
+	for _, item := range items {
+		stmt, values := h.batchStatement(item)
+		b.Query(stmt, values...)
+	}
+}
+
+// executeBatch runs an unlogged batch of items (or a single query for a lone item), retrying it with an exponential backoff
+// as long as Cassandra returns a transient error. The batch is sent to owner first, if known.
+func (h *Handler) executeBatch(items []CassandraSet, owner *gocql.HostInfo) error {
+	backoff := viper.GetDuration("CassandraBatchRetryBackoffMs")
+	hasDeletes := false
+	for _, item := range items {
+		hasDeletes = hasDeletes || item.Deleted
+	}
+	for attempt := 0; ; attempt++ {
 		start := timer.Now()
-		err := singleton.session.ExecuteBatch(b)
-		if err != nil {
-			metrics.IncCounter(MetricCmdSetBatchErrors)
-			log.Println("[ERROR] Batched Cassandra SET returned an error. ", err)
+		var err error
+		if len(items) == 1 {
+			// A single item is written outside of any batch, routed by its own key
+			stmt, values := h.batchStatement(items[0])
+			err = h.session.Query(stmt, values...).Exec()
 		} else {
+			b := h.session.NewBatch(gocql.UnloggedBatch)
+			h.batchQueries(b, items)
+
+			// exec CQL batch
+			if owner != nil {
+				h.router.routes.Store(b, owner)
+			}
+			err = h.session.ExecuteBatch(b)
+			h.router.routes.Delete(b)
+		}
+		if err == nil {
 			metrics.IncCounter(MetricCmdSetBatchSuccess)
 			metrics.ObserveHist(HistSetBatch, timer.Since(start))
+			if hasDeletes {
+				metrics.ObserveHist(HistDeleteBatch, timer.Since(start))
+			}
+			return nil
 		}
-	}
+		metrics.IncCounter(MetricCmdSetBatchErrors)
+		log.Println("[ERROR] Batched Cassandra SET returned an error. ", err)
 
-	// TODO: we need to protect this timer reset, and make it thread safe !!
-	singleton.buffertimer.Reset(200 * time.Millisecond)
+		if attempt >= viper.GetInt("CassandraBatchRetries") || backendError(err) != common.ErrTempFailure {
+			return err
+		}
+		metrics.IncCounter(MetricCmdSetBatchRetries)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
 }
 
 // InitCassandraConn initialize Cassandra global connection, call it once before starting ListenAndServe()
@@ -107,25 +490,89 @@ func InitCassandraConn() error {
 		clust := gocql.NewCluster(viper.GetString("CassandraHostname"))
 		clust.Keyspace = viper.GetString("CassandraKeyspace")
 		clust.Consistency = gocql.LocalOne
+		clust.SerialConsistency = gocql.LocalSerial
 		clust.Timeout = viper.GetDuration("CassandraTimeoutMs")
 		clust.ConnectTimeout = viper.GetDuration("CassandraConnectTimeoutMs")
+		router := newBatchRouter()
+		clust.PoolConfig.HostSelectionPolicy = router
 		sess, err := clust.CreateSession()
 		if err != nil {
 			return err
 		}
 
+		keyspace := viper.GetString("CassandraKeyspace")
+		bucket := viper.GetString("CassandraBucket")
+		flagscol, err := checkSchema(sess, keyspace, bucket)
+		if err != nil {
+			sess.Close()
+			return err
+		}
+		if !flagscol {
+			log.Println("[WARN] No flagscol column in Cassandra table, memcached flags won't be stored")
+		}
+
+		getErrorMode := viper.GetString("CassandraGetErrorMode")
+		if getErrorMode != getErrorModeError && getErrorMode != getErrorModeMiss {
+			sess.Close()
+			return fmt.Errorf("Unknown get error mode %q", getErrorMode)
+		}
+
+		var deadletter DeadLetterFunc
+		if path := viper.GetString("CassandraDeadLetterFile"); path != "" {
+			if deadletter, err = newDeadLetterFile(path); err != nil {
+				sess.Close()
+				return err
+			}
+		}
+
 		singleton = &Handler{
 			session:      sess,
 			setbuffer:    make(chan CassandraSet, viper.GetInt("CassandraBatchBufferItemSize")),
-			buffertimer:  time.AfterFunc(viper.GetDuration("CassandraBatchBufferMaxAgeMs"), FlushBuffer),
-			readonlymode: false,
+			slots:        make(chan struct{}, viper.GetInt("CassandraBatchBufferItemSize")),
+			shedpercent:  viper.GetInt("CassandraBatchBufferShedPercent"),
+			buftimeout:   viper.GetDuration("CassandraBatchBufferTimeoutMs"),
+			flushreq:     make(chan chan struct{}),
+			batches:      make(chan batchJob, viper.GetInt("CassandraBatchQueueSize")),
+			readonlymode: 0,
+			flagscol:     flagscol,
+			syncwrites:   viper.GetBool("CassandraSyncWrites"),
+			lwtreplace:   viper.GetBool("CassandraLWTReplace"),
+			lwtdelete:    viper.GetBool("CassandraLWTDelete"),
+			bufdeletes:   viper.GetBool("CassandraBufferedDeletes"),
+			missonerror:  getErrorMode == getErrorModeMiss,
+			getlimit:     viper.GetInt("CassandraGetConcurrency"),
+			commitwait:   viper.GetDuration("CassandraBatchBufferMaxAgeMs") + viper.GetDuration("CassandraTimeoutMs"),
+			stmts:        buildStatements(keyspace, bucket, flagscol),
+			pending:      newPendingIndex(),
+			deadletter:   deadletter,
+			router:       router,
+			tokenaware:   viper.GetBool("CassandraTokenAwareBatches"),
 		}
 
-		go bufferSizeCheckLoop()
-	}
+		writers := viper.GetInt("CassandraBatchWriters")
+		if writers < 1 {
+			writers = 1
+		}
+		for i := 0; i < writers; i++ {
+			go singleton.batchWriter()
+		}
+		go singleton.flushLoop()
 
-	// TODO : prepare Cassandra statements for common queries
-	// Currently using session.bind() seems to registers statements if they don't exists in C*
+		if dir := viper.GetString("CassandraSpillDir"); dir != "" {
+			spill, err := openSpillQueue(dir, viper.GetInt64("CassandraSpillMaxBytes"))
+			if err != nil {
+				return err
+			}
+			singleton.spill = spill
+			go singleton.spillReplayLoop()
+		}
+
+		if dir := viper.GetString("CassandraWALDir"); dir != "" {
+			if err := singleton.replayWAL(dir); err != nil {
+				return err
+			}
+		}
+	}
 
 	return nil
 }
@@ -150,60 +597,205 @@ func computeExpTime(Exptime uint32) uint32 {
 }
 
 func (h *Handler) Set(cmd common.SetRequest) error {
-	if h.readonlymode {
+	defer h.request()()
+
+	if h.readonly() {
 		return common.ErrItemNotStored
 	}
-	realExptime := computeExpTime(cmd.Exptime)
-	start := timer.Now()
-	h.setbuffer <- CassandraSet{
+	return h.bufferSet(CassandraSet{
 		Key:     cmd.Key,
 		Data:    cmd.Data,
 		Flags:   cmd.Flags,
-		Exptime: realExptime,
+		Exptime: computeExpTime(cmd.Exptime),
+	})
+}
+
+// bufferSet indexes an item as a pending write and pushes it to the set buffer.
+// In synchronous write mode, it also waits for the batch holding the item to be executed.
+// A set is rejected with ErrBusy when the buffer fills beyond CassandraBatchBufferShedPercent,
+// or when no room was freed in the buffer within CassandraBatchBufferTimeoutMs.
+func (h *Handler) bufferSet(item CassandraSet) error {
+	if h.shedpercent > 0 && len(h.slots)*100 >= cap(h.slots)*h.shedpercent {
+		metrics.IncCounter(MetricCmdSetBufferRejected)
+		return common.ErrBusy
+	}
+
+	// Room is reserved in the buffer before indexing the item,
+	// a rejected item must never be seen by reads.
+	start := timer.Now()
+	if h.buftimeout > 0 {
+		select {
+		case h.slots <- struct{}{}:
+		default:
+			t := time.NewTimer(h.buftimeout)
+			select {
+			case h.slots <- struct{}{}:
+				t.Stop()
+			case <-t.C:
+				metrics.IncCounter(MetricCmdSetBufferRejected)
+				return common.ErrBusy
+			}
+		}
+	} else {
+		h.slots <- struct{}{}
 	}
 	metrics.ObserveHist(HistSetBufferWait, timer.Since(start))
-	// TODO : maybe add a set timeout that return "not_stored" in case of buffer error ?
-	return nil
+
+	if h.syncwrites {
+		item.done = make(chan error, 1)
+	}
+	item.seq = h.pending.next()
+	item.buffered = time.Now()
+	if h.wal != nil {
+		if err := h.wal.append(&item); err != nil {
+			<-h.slots
+			metrics.IncCounter(MetricWALErrors)
+			log.Println("[ERROR] Unable to log SET in the WAL. ", err)
+			return common.ErrInternal
+		}
+	}
+	h.pending.set(item)
+	h.buffered(item)
+	h.setbuffer <- item
+
+	if item.done == nil {
+		return nil
+	}
+	return <-item.done
+}
+
+// awaitPending waits for the pending write of a key, if any, to be committed in Cassandra.
+// A read-modify-write must read the key from Cassandra, and its lightweight transaction would
+// otherwise be overwritten by the older write once flushed. It returns ErrTempFailure if the key
+// is still pending after a few newer writes, or once CassandraBatchBufferMaxAgeMs and
+// CassandraTimeoutMs elapsed.
+func (h *Handler) awaitPending(key []byte) error {
+	for i := 0; i < casMaxRetries; i++ {
+		w, ok := h.pending.lookup(key)
+		if !ok {
+			return nil
+		}
+		if !h.waitCommitted(key, w.seq) {
+			return common.ErrTempFailure
+		}
+	}
+	return common.ErrTempFailure
+}
+
+// waitCommitted waits for a pending write to be committed or superseded, it returns false on timeout
+func (h *Handler) waitCommitted(key []byte, seq uint64) bool {
+	deadline := time.Now().Add(h.commitwait)
+	for {
+		if w, ok := h.pending.lookup(key); !ok || w.seq != seq {
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
 }
 
 func (h *Handler) Add(cmd common.SetRequest) error {
+	defer h.request()()
 
+	if h.readonly() {
+		return common.ErrItemNotStored
+	}
+
+	// A pending write of the key tells if it exists before asking Cassandra. A pending deletion
+	// (or expired write) must reach Cassandra first, the old row would otherwise fail the add.
+	if w, ok := h.pending.lookup(cmd.Key); ok {
+		if !w.deleted && !w.expired(time.Now()) {
+			return common.ErrKeyExists
+		}
+		if err := h.awaitPending(cmd.Key); err != nil {
+			return err
+		}
+	}
+
+	// Add is written synchronously using a lightweight transaction,
+	// the buffered batch path can't tell if the key already exists.
+	item := CassandraSet{
+		Key:     cmd.Key,
+		Data:    cmd.Data,
+		Flags:   cmd.Flags,
+		Exptime: computeExpTime(cmd.Exptime),
+	}
+	applied, err := h.session.Query(h.stmts.add, h.updateValues(item)...).MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		log.Println("[ERROR] Cassandra ADD returned an error. ", err)
+		return common.ErrInternal
+	}
+	if !applied {
+		return common.ErrKeyExists
+	}
 	return nil
 }
 
 func (h *Handler) Replace(cmd common.SetRequest) error {
-	if h.readonlymode {
+	defer h.request()()
+
+	if h.readonly() {
 		return common.ErrItemNotStored
 	}
 
-	key_qi := func(q *gocql.QueryInfo) ([]interface{}, error) {
-		values := make([]interface{}, 1)
-		values[0] = cmd.Key
-		return values, nil
+	// A pending write of the key tells if it exists before asking Cassandra,
+	// the new value then follows the pending one through the set buffer.
+	if w, ok := h.pending.lookup(cmd.Key); ok {
+		if w.deleted || w.expired(time.Now()) {
+			return common.ErrKeyNotFound
+		}
+		return h.bufferSet(CassandraSet{
+			Key:     cmd.Key,
+			Data:    cmd.Data,
+			Flags:   cmd.Flags,
+			Exptime: computeExpTime(cmd.Exptime),
+		})
+	}
+
+	if !h.lwtreplace {
+		return h.bufferedReplace(cmd)
 	}
+
+	// Replace is written synchronously using a lightweight transaction,
+	// so a key deleted or expired in the meantime can't be brought back.
+	item := CassandraSet{
+		Key:     cmd.Key,
+		Data:    cmd.Data,
+		Flags:   cmd.Flags,
+		Exptime: computeExpTime(cmd.Exptime),
+	}
+	applied, err := h.session.Query(h.stmts.replace, h.updateValues(item)...).MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		log.Println("[ERROR] Cassandra REPLACE returned an error. ", err)
+		return common.ErrInternal
+	}
+	if !applied {
+		return common.ErrKeyNotFound
+	}
+	return nil
+}
+
+// bufferedReplace checks if the key exists before pushing the new value to the write buffer.
+// It's faster than the lightweight transaction but racy : a key deleted or expired between
+// the check and the batched write will be brought back.
+func (h *Handler) bufferedReplace(cmd common.SetRequest) error {
+	// A row whose value expired has no value writetime
 	var wtime uint
-	if err := h.session.Bind(
-		/* TODO: better use "UPDATE ... IF EXISTS" pattern because it make use of
-		"Lightweight transactions" and it's more consistent. */
-		fmt.Sprintf(
-			"SELECT writetime(valuecol) FROM %s.%s WHERE keycol=? LIMIT 1",
-			viper.GetString("CassandraKeyspace"),
-			viper.GetString("CassandraBucket"),
-		),
-		key_qi,
-	).Scan(&wtime); err == nil {
-		realExptime := computeExpTime(cmd.Exptime)
-		start := timer.Now()
-		h.setbuffer <- CassandraSet{
+	err := h.session.Query(h.stmts.writetime, cmd.Key).Scan(&wtime)
+	if err == nil && wtime == 0 {
+		err = gocql.ErrNotFound
+	}
+	if err == nil {
+		return h.bufferSet(CassandraSet{
 			Key:     cmd.Key,
 			Data:    cmd.Data,
 			Flags:   cmd.Flags,
-			Exptime: realExptime,
-		}
-		metrics.ObserveHist(HistSetBufferWait, timer.Since(start))
-		return nil
+			Exptime: computeExpTime(cmd.Exptime),
+		})
 	} else {
-		if err.Error() == "not found" {
+		if err == gocql.ErrNotFound {
 			return common.ErrKeyNotFound
 		} else {
 			return common.ErrInternal
@@ -212,136 +804,417 @@ func (h *Handler) Replace(cmd common.SetRequest) error {
 }
 
 func (h *Handler) Append(cmd common.SetRequest) error {
-
-	return nil
+	return h.concat(cmd, false)
 }
 
 func (h *Handler) Prepend(cmd common.SetRequest) error {
+	return h.concat(cmd, true)
+}
 
-	return nil
+// concat appends (or prepends) data to the value of an existing key, keeping its flags and TTL.
+// The read-modify-write is protected by a lightweight transaction on the previous value,
+// so it is retried instead of losing data when a concurrent writer updated the key.
+func (h *Handler) concat(cmd common.SetRequest, prepend bool) error {
+	defer h.request()()
+
+	if h.readonly() {
+		return common.ErrItemNotStored
+	}
+
+	// A key deleted or expired in the set buffer is missing, a key set in the buffer is appended once written
+	if w, ok := h.pending.lookup(cmd.Key); ok && (w.deleted || w.expired(time.Now())) {
+		return common.ErrKeyNotFound
+	}
+	if err := h.awaitPending(cmd.Key); err != nil {
+		return err
+	}
+
+	for i := 0; i < casMaxRetries; i++ {
+		var val []byte
+		var ttl uint32
+		err := h.session.Query(h.stmts.readTTL, cmd.Key).Scan(&val, &ttl)
+		if err == nil && val == nil {
+			err = gocql.ErrNotFound
+		}
+		if err != nil {
+			if err == gocql.ErrNotFound {
+				return common.ErrKeyNotFound
+			}
+			log.Println("[ERROR] Cassandra APPEND/PREPEND read returned an error. ", err)
+			return common.ErrInternal
+		}
+
+		newval := make([]byte, 0, len(val)+len(cmd.Data))
+		if prepend {
+			newval = append(append(newval, cmd.Data...), val...)
+		} else {
+			newval = append(append(newval, val...), cmd.Data...)
+		}
+
+		applied, err := h.session.Query(
+			h.stmts.concat,
+			ttl,
+			newval,
+			cmd.Key,
+			val,
+		).MapScanCAS(make(map[string]interface{}))
+		if err != nil {
+			log.Println("[ERROR] Cassandra APPEND/PREPEND returned an error. ", err)
+			return common.ErrInternal
+		}
+		if applied {
+			return nil
+		}
+	}
+
+	log.Println("[WARN] Too much contention on key, giving up APPEND/PREPEND after", casMaxRetries, "attempts")
+	return common.ErrTempFailure
+}
+
+// fanOut calls fn for each index in [0, n), running at most limit calls at once
+func fanOut(limit, n int, fn func(idx int)) {
+	if limit < 1 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for idx := 0; idx < n; idx++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(idx int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(idx)
+		}(idx)
+	}
+	wg.Wait()
+}
+
+// getFailure records the first backend error of a multi-get
+type getFailure struct {
+	sync.Mutex
+	err error
+}
+
+func (f *getFailure) set(err error) {
+	f.Lock()
+	if f.err == nil {
+		f.err = err
+	}
+	f.Unlock()
+}
+
+func (f *getFailure) get() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.err
+}
+
+// missOnError tells if a failed key read is answered as a miss : a key not found always is,
+// a backend error only in the miss CassandraGetErrorMode.
+func (h *Handler) missOnError(err error) bool {
+	if err == gocql.ErrNotFound {
+		return true
+	}
+	log.Println("[ERROR] Cassandra GET returned an error. ", err)
+	if h.missonerror {
+		metrics.IncCounter(MetricCmdGetErrorsAsMisses)
+		return true
+	}
+	return false
 }
 
 func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
 	dataOut := make(chan common.GetResponse, len(cmd.Keys))
-	errorOut := make(chan error)
+	errorOut := make(chan error, 1)
 
-	for idx, key := range cmd.Keys {
-		key_qi := func(q *gocql.QueryInfo) ([]interface{}, error) {
-			values := make([]interface{}, 1)
-			values[0] = key
-			return values, nil
-		}
+	// Keys are read in parallel and responses are sent back in completion order,
+	// each response carrying the opaque and quiet flag of its own key.
+	// A backend error ends the request, no response is sent for the keys read after it.
+	go func() {
+		var failure getFailure
+		fanOut(h.getlimit, len(cmd.Keys), func(idx int) {
+			key := cmd.Keys[idx]
+			if failure.get() != nil {
+				return
+			}
 
-		var val []byte
+			if w, ok := h.pending.lookup(key); ok {
+				metrics.IncCounter(MetricCmdGetSetBufferHits)
+				miss := w.deleted || w.expired(time.Now())
+				dataOut <- common.GetResponse{
+					Miss:   miss,
+					Quiet:  cmd.Quiet[idx],
+					Opaque: cmd.Opaques[idx],
+					Flags:  w.item.Flags,
+					Key:    key,
+					Data:   w.item.Data,
+				}
+				return
+			}
 
-		if err := h.session.Bind(
-			fmt.Sprintf(
-				"SELECT keycol,valuecol FROM %s.%s where keycol=?",
-				viper.GetString("CassandraKeyspace"),
-				viper.GetString("CassandraBucket"),
-			),
-			key_qi,
-		).Scan(&key, &val); err == nil {
-			dataOut <- common.GetResponse{
-				Miss:   false,
-				Quiet:  cmd.Quiet[idx],
-				Opaque: cmd.Opaques[idx],
-				Flags:  0,
-				Key:    []byte(key),
-				Data:   val,
+			var val []byte
+			var flags uint32
+			dest := []interface{}{&key, &val}
+			if h.flagscol {
+				dest = append(dest, &flags)
 			}
-		} else {
-			dataOut <- common.GetResponse{
-				Miss:   true,
-				Quiet:  cmd.Quiet[idx],
-				Opaque: cmd.Opaques[idx],
-				Key:    []byte(key),
-				Data:   nil,
+
+			err := h.session.Query(h.stmts.get, key).Scan(dest...)
+			if err == nil && val == nil {
+				// Row left without value once its value expired
+				err = gocql.ErrNotFound
+			}
+			if err != nil && !h.missOnError(err) {
+				failure.set(err)
+				return
+			}
+			if err == nil {
+				dataOut <- common.GetResponse{
+					Miss:   false,
+					Quiet:  cmd.Quiet[idx],
+					Opaque: cmd.Opaques[idx],
+					Flags:  flags,
+					Key:    []byte(key),
+					Data:   val,
+				}
+			} else {
+				dataOut <- common.GetResponse{
+					Miss:   true,
+					Quiet:  cmd.Quiet[idx],
+					Opaque: cmd.Opaques[idx],
+					Key:    []byte(key),
+					Data:   nil,
+				}
 			}
+		})
+
+		if err := failure.get(); err != nil {
+			errorOut <- backendError(err)
 		}
-	}
+		close(dataOut)
+		close(errorOut)
+	}()
 
-	close(dataOut)
-	close(errorOut)
 	return dataOut, errorOut
 }
 
 func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
 	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
-	errorOut := make(chan error)
+	errorOut := make(chan error, 1)
 
-	for idx, key := range cmd.Keys {
-		key_qi := func(q *gocql.QueryInfo) ([]interface{}, error) {
-			values := make([]interface{}, 1)
-			values[0] = key
-			return values, nil
-		}
+	// Keys are read in parallel and responses are sent back in completion order,
+	// each response carrying the opaque and quiet flag of its own key.
+	// A backend error ends the request, no response is sent for the keys read after it.
+	go func() {
+		var failure getFailure
+		fanOut(h.getlimit, len(cmd.Keys), func(idx int) {
+			key := cmd.Keys[idx]
+			if failure.get() != nil {
+				return
+			}
 
-		var val []byte
-		var ttl uint32
+			if w, ok := h.pending.lookup(key); ok {
+				metrics.IncCounter(MetricCmdGetSetBufferHits)
+				now := time.Now()
+				miss := w.deleted || w.expired(now)
+				dataOut <- common.GetEResponse{
+					Miss:    miss,
+					Quiet:   cmd.Quiet[idx],
+					Opaque:  cmd.Opaques[idx],
+					Flags:   w.item.Flags,
+					Key:     key,
+					Data:    w.item.Data,
+					Exptime: w.ttl(now),
+				}
+				return
+			}
 
-		if err := h.session.Bind(
-			fmt.Sprintf(
-				"SELECT keycol,valuecol,TTL(valuecol) FROM %s.%s where keycol=?",
-				viper.GetString("CassandraKeyspace"),
-				viper.GetString("CassandraBucket"),
-			),
-			key_qi,
-		).Scan(&key, &val, &ttl); err == nil {
-			dataOut <- common.GetEResponse{
-				Miss:    false,
-				Quiet:   cmd.Quiet[idx],
-				Opaque:  cmd.Opaques[idx],
-				Flags:   0,
-				Key:     []byte(key),
-				Data:    val,
-				Exptime: ttl,
+			var val []byte
+			var ttl uint32
+			var flags uint32
+			dest := []interface{}{&key, &val}
+			if h.flagscol {
+				dest = append(dest, &flags)
 			}
-		} else {
-			dataOut <- common.GetEResponse{
-				Miss:   true,
-				Quiet:  cmd.Quiet[idx],
-				Opaque: cmd.Opaques[idx],
-				Key:    []byte(key),
-				Data:   nil,
+			dest = append(dest, &ttl)
+
+			err := h.session.Query(h.stmts.getE, key).Scan(dest...)
+			if err == nil && val == nil {
+				// Row left without value once its value expired
+				err = gocql.ErrNotFound
 			}
+			if err != nil && !h.missOnError(err) {
+				failure.set(err)
+				return
+			}
+			if err == nil {
+				dataOut <- common.GetEResponse{
+					Miss:    false,
+					Quiet:   cmd.Quiet[idx],
+					Opaque:  cmd.Opaques[idx],
+					Flags:   flags,
+					Key:     []byte(key),
+					Data:    val,
+					Exptime: ttl,
+				}
+			} else {
+				dataOut <- common.GetEResponse{
+					Miss:   true,
+					Quiet:  cmd.Quiet[idx],
+					Opaque: cmd.Opaques[idx],
+					Key:    []byte(key),
+					Data:   nil,
+				}
+			}
+		})
+
+		if err := failure.get(); err != nil {
+			errorOut <- backendError(err)
 		}
-	}
+		close(dataOut)
+		close(errorOut)
+	}()
 
-	close(dataOut)
-	close(errorOut)
 	return dataOut, errorOut
 }
 
 func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	defer h.request()()
+
+	if h.readonly() {
+		return common.GetResponse{}, common.ErrItemNotStored
+	}
+
+	item, err := h.retouch(cmd.Key, cmd.Exptime)
+	if err == common.ErrKeyNotFound {
+		return common.GetResponse{
+			Miss:   true,
+			Quiet:  cmd.Quiet,
+			Opaque: cmd.Opaque,
+			Key:    cmd.Key,
+		}, nil
+	} else if err != nil {
+		return common.GetResponse{}, err
+	}
+
 	return common.GetResponse{
-		Miss:   true,
+		Miss:   false,
+		Quiet:  cmd.Quiet,
 		Opaque: cmd.Opaque,
+		Flags:  item.Flags,
 		Key:    cmd.Key,
+		Data:   item.Data,
 	}, nil
 }
 
+// Delete removes a key. Reads see the key as deleted as soon as the deletion starts, and the deletion
+// is timestamped after every write of the key already buffered, so they can't bring the key back once flushed.
+// With CassandraLWTDelete, a missing key is reported as not found using a lightweight transaction.
+// Otherwise with CassandraBufferedDeletes, the deletion goes through the set buffer.
 func (h *Handler) Delete(cmd common.DeleteRequest) error {
-	kv_qi := func(q *gocql.QueryInfo) ([]interface{}, error) {
-		values := make([]interface{}, 1)
-		values[0] = cmd.Key
-		return values, nil
-	}
-
-	if err := h.session.Bind(
-		fmt.Sprintf(
-			"DELETE FROM %s.%s WHERE keycol=?",
-			viper.GetString("CassandraKeyspace"),
-			viper.GetString("CassandraBucket"),
-		),
-		kv_qi,
-	).Exec(); err != nil {
-		return err
+	// Buffered deletes always succeed, the deletion is written in a batch like sets.
+	// They're only written synchronously in readonly mode, the buffer is being drained.
+	defer h.request()()
+
+	if atomic.LoadInt32(&h.closing) == 1 {
+		return common.ErrTempFailure
+	}
+	if h.bufdeletes && !h.lwtdelete && !h.readonly() {
+		return h.bufferSet(CassandraSet{Key: cmd.Key, Deleted: true})
+	}
+
+	seq, prev, buffered := h.pending.delete(cmd.Key)
+	defer h.pending.commit(cmd.Key, seq)
+
+	// A key written in the set buffer may not be in Cassandra yet, its pending write tells if it exists
+	if h.lwtdelete && (!buffered || prev.deleted) {
+		applied, err := h.session.Query(h.stmts.deleteLWT, cmd.Key).MapScanCAS(make(map[string]interface{}))
+		if err != nil {
+			log.Println("[ERROR] Cassandra DELETE returned an error. ", err)
+			return backendError(err)
+		}
+		if !applied {
+			return common.ErrKeyNotFound
+		}
+		return nil
+	}
+
+	if err := h.session.Query(h.stmts.delete, int64(seq), cmd.Key).Exec(); err != nil {
+		log.Println("[ERROR] Cassandra DELETE returned an error. ", err)
+		return backendError(err)
+	}
+	if h.lwtdelete && prev.expired(time.Now()) {
+		return common.ErrKeyNotFound
 	}
 	return nil
 }
 
 func (h *Handler) Touch(cmd common.TouchRequest) error {
+	defer h.request()()
 
-	return nil
+	if h.readonly() {
+		return common.ErrItemNotStored
+	}
+
+	_, err := h.retouch(cmd.Key, cmd.Exptime)
+	return err
+}
+
+// retouch reads an item and writes it back with a new TTL, Cassandra TTLs are set per cell and
+// can't be updated alone. The write is conditioned on the value read, so a concurrent update of
+// the key is never overwritten by the old value. A key whose write is still in the set buffer
+// is known without asking Cassandra, its pending value follows it through the buffer with the new TTL.
+func (h *Handler) retouch(key []byte, exptime uint32) (CassandraSet, error) {
+	if w, ok := h.pending.lookup(key); ok {
+		if w.deleted || w.expired(time.Now()) {
+			return CassandraSet{}, common.ErrKeyNotFound
+		}
+		item := CassandraSet{
+			Key:     key,
+			Data:    w.item.Data,
+			Flags:   w.item.Flags,
+			Exptime: computeExpTime(exptime),
+		}
+		return item, h.bufferSet(item)
+	}
+
+	for i := 0; i < casMaxRetries; i++ {
+		item := CassandraSet{
+			Key:     key,
+			Exptime: computeExpTime(exptime),
+		}
+		dest := []interface{}{&item.Data}
+		if h.flagscol {
+			dest = append(dest, &item.Flags)
+		}
+
+		err := h.session.Query(h.stmts.read, key).Scan(dest...)
+		if err == nil && item.Data == nil {
+			// Row left without value once its value expired
+			err = gocql.ErrNotFound
+		}
+		if err != nil {
+			if err == gocql.ErrNotFound {
+				return item, common.ErrKeyNotFound
+			}
+			log.Println("[ERROR] Cassandra TOUCH read returned an error. ", err)
+			return item, common.ErrInternal
+		}
+
+		values := append(h.updateValues(item), item.Data)
+		applied, err := h.session.Query(h.stmts.retouch, values...).MapScanCAS(make(map[string]interface{}))
+		if err != nil {
+			log.Println("[ERROR] Cassandra TOUCH returned an error. ", err)
+			return item, common.ErrInternal
+		}
+		if applied {
+			return item, nil
+		}
+	}
+
+	log.Println("[WARN] Too much contention on key, giving up TOUCH after", casMaxRetries, "attempts")
+	return CassandraSet{}, common.ErrTempFailure
 }
@@ -0,0 +1,122 @@
+package cassandra
+
+import (
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+func TestPendingReadModifyWrite(t *testing.T) {
+	// A set followed by an append of the same key within one buffer window
+	t.Run("AppendAfterBufferedSet", func(t *testing.T) {
+		h := &Handler{pending: newPendingIndex(), commitwait: time.Second}
+		seq := h.pending.set(CassandraSet{Key: []byte("key"), Data: []byte("foo")})
+
+		// The batch holding the set is written after a while
+		flushed := make(chan time.Time, 1)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			flushed <- time.Now()
+			h.pending.commit([]byte("key"), seq)
+		}()
+
+		if err := h.awaitPending([]byte("key")); err != nil {
+			t.Fatalf("Expected append to wait for the buffered set, got %v", err)
+		}
+		if time.Now().Before(<-flushed) {
+			t.Fatalf("Expected append to read the key only once the buffered set is written")
+		}
+	})
+
+	t.Run("AppendStillBuffered", func(t *testing.T) {
+		h := &Handler{pending: newPendingIndex(), commitwait: 20 * time.Millisecond}
+		h.pending.set(CassandraSet{Key: []byte("key"), Data: []byte("foo")})
+
+		err := h.concat(common.SetRequest{Key: []byte("key"), Data: []byte("bar")}, false)
+		if err != common.ErrTempFailure {
+			t.Fatalf("Expected append of a key stuck in the buffer to fail temporarily, got %v", err)
+		}
+	})
+
+	t.Run("AppendBufferedDelete", func(t *testing.T) {
+		h := &Handler{pending: newPendingIndex(), commitwait: time.Second}
+		h.pending.set(CassandraSet{Key: []byte("key"), Deleted: true})
+
+		err := h.concat(common.SetRequest{Key: []byte("key"), Data: []byte("bar")}, false)
+		if err != common.ErrKeyNotFound {
+			t.Fatalf("Expected append of a key deleted in the buffer to be not found, got %v", err)
+		}
+	})
+
+	t.Run("AppendBufferedExpired", func(t *testing.T) {
+		h := &Handler{pending: newPendingIndex(), commitwait: time.Second}
+		h.pending.record("key", pendingWrite{
+			item:     CassandraSet{Key: []byte("key"), Data: []byte("foo")},
+			deadline: time.Now().Add(-time.Second),
+		})
+
+		err := h.concat(common.SetRequest{Key: []byte("key"), Data: []byte("bar")}, true)
+		if err != common.ErrKeyNotFound {
+			t.Fatalf("Expected prepend of a key expired in the buffer to be not found, got %v", err)
+		}
+	})
+
+	t.Run("TouchBufferedDelete", func(t *testing.T) {
+		h := &Handler{pending: newPendingIndex(), commitwait: time.Second}
+		h.pending.delete([]byte("key"))
+
+		if err := h.Touch(common.TouchRequest{Key: []byte("key"), Exptime: 60}); err != common.ErrKeyNotFound {
+			t.Fatalf("Expected touch of a key deleted in the buffer to be not found, got %v", err)
+		}
+		res, err := h.GAT(common.GATRequest{Key: []byte("key"), Exptime: 60})
+		if err != nil || !res.Miss {
+			t.Fatalf("Expected gat of a key deleted in the buffer to miss, got %#v, %v", res, err)
+		}
+	})
+
+	// A set followed by a touch and a gat of the same key within one buffer window
+	t.Run("TouchStillBuffered", func(t *testing.T) {
+		h := &Handler{
+			pending:   newPendingIndex(),
+			setbuffer: make(chan CassandraSet, 2),
+			slots:     make(chan struct{}, 2),
+		}
+		h.pending.set(CassandraSet{Key: []byte("key"), Data: []byte("v2"), Flags: 3})
+
+		if err := h.Touch(common.TouchRequest{Key: []byte("key"), Exptime: 60}); err != nil {
+			t.Fatalf("Expected touch of a key set in the buffer to succeed, got %v", err)
+		}
+		res, err := h.GAT(common.GATRequest{Key: []byte("key"), Exptime: 120})
+		if err != nil || res.Miss || string(res.Data) != "v2" || res.Flags != 3 {
+			t.Fatalf("Expected gat of a key set in the buffer to hit, got %#v, %v", res, err)
+		}
+
+		if len(h.setbuffer) != 2 {
+			t.Fatalf("Expected the pending value to be buffered again, got %d buffered items", len(h.setbuffer))
+		}
+		w, ok := h.pending.lookup([]byte("key"))
+		if !ok || string(w.item.Data) != "v2" || w.item.Flags != 3 || w.item.Exptime != 120 {
+			t.Fatalf("Expected the pending value to be rewritten with the new TTL, got %#v", w.item)
+		}
+	})
+
+	t.Run("AddBufferedSet", func(t *testing.T) {
+		h := &Handler{pending: newPendingIndex(), commitwait: time.Second}
+		h.pending.set(CassandraSet{Key: []byte("key"), Data: []byte("foo")})
+
+		if err := h.Add(common.SetRequest{Key: []byte("key"), Data: []byte("bar")}); err != common.ErrKeyExists {
+			t.Fatalf("Expected add of a key set in the buffer to fail, got %v", err)
+		}
+	})
+
+	// A buffered delete followed by an add of the same key within one buffer window
+	t.Run("AddBufferedDelete", func(t *testing.T) {
+		h := &Handler{pending: newPendingIndex(), commitwait: 20 * time.Millisecond}
+		h.pending.set(CassandraSet{Key: []byte("key"), Deleted: true})
+
+		if err := h.Add(common.SetRequest{Key: []byte("key"), Data: []byte("bar")}); err != common.ErrTempFailure {
+			t.Fatalf("Expected add to wait for the buffered delete to be written, got %v", err)
+		}
+	})
+}
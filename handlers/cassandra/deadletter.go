@@ -0,0 +1,60 @@
+package cassandra
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// DeadLetterFunc receives the items of a batch given up after all retries, along with the last error
+type DeadLetterFunc func(items []CassandraSet, err error)
+
+// SetDeadLetterHandler replaces the dead-letter sink of the Cassandra handler,
+// call it after InitCassandraConn() and before ListenAndServe()
+func SetDeadLetterHandler(f DeadLetterFunc) {
+	singleton.deadletter = f
+}
+
+// deadLetter is the replayable record of an item written to the dead-letter file
+type deadLetter struct {
+	Key     []byte `json:"key"`
+	Data    []byte `json:"data"`
+	Flags   uint32 `json:"flags"`
+	Expires int64  `json:"expires,omitempty"` // unix time, omitted if the item never expires
+	Deleted bool   `json:"deleted,omitempty"` // buffered deletion of the key
+	Error   string `json:"error"`
+}
+
+// newDeadLetterFile returns a sink appending given up items to a file, one JSON record per line
+func newDeadLetterFile(path string) (DeadLetterFunc, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock sync.Mutex
+	enc := json.NewEncoder(f)
+	return func(items []CassandraSet, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		for _, item := range items {
+			rec := deadLetter{
+				Key:     item.Key,
+				Data:    item.Data,
+				Flags:   item.Flags,
+				Deleted: item.Deleted,
+				Error:   err.Error(),
+			}
+			if item.Exptime > 0 {
+				rec.Expires = item.buffered.Add(time.Duration(item.Exptime) * time.Second).Unix()
+			}
+			if encErr := enc.Encode(rec); encErr != nil {
+				log.Println("[ERROR] Unable to write to dead-letter file. ", encErr)
+				return
+			}
+		}
+	}, nil
+}
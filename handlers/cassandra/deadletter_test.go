@@ -0,0 +1,60 @@
+package cassandra
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memandra")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deadletter.json")
+
+	sink, err := newDeadLetterFile(path)
+	if err != nil {
+		t.Fatalf("Unable to open dead-letter file: %v", err)
+	}
+	buffered := time.Now()
+	sink([]CassandraSet{
+		{Key: []byte("key1"), Data: []byte("foo"), Flags: 42, Exptime: 60, buffered: buffered},
+		{Key: []byte("key2"), Data: []byte("bar")},
+	}, errors.New("boom"))
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Unable to read dead-letter file: %v", err)
+	}
+	defer f.Close()
+
+	var recs []deadLetter
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("Invalid dead-letter record %q: %v", scanner.Text(), err)
+		}
+		recs = append(recs, rec)
+	}
+
+	if len(recs) != 2 {
+		t.Fatalf("Expected 2 dead-letter records, got %d", len(recs))
+	}
+	if string(recs[0].Key) != "key1" || string(recs[0].Data) != "foo" || recs[0].Flags != 42 || recs[0].Error != "boom" {
+		t.Fatalf("Unexpected dead-letter record %#v", recs[0])
+	}
+	if recs[0].Expires != buffered.Add(60*time.Second).Unix() {
+		t.Fatalf("Expected record to expire at %d, got %d", buffered.Add(60*time.Second).Unix(), recs[0].Expires)
+	}
+	if recs[1].Expires != 0 {
+		t.Fatalf("Expected record without TTL to never expire, got %d", recs[1].Expires)
+	}
+}
@@ -0,0 +1,76 @@
+package cassandra
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// request counts a write request as in flight until the returned function is called.
+// It must be counted before checking readonly mode, so drain waits for every write that passed the check.
+func (h *Handler) request() func() {
+	atomic.AddInt64(&h.requests, 1)
+	return func() {
+		atomic.AddInt64(&h.requests, -1)
+	}
+}
+
+// Drain flushes the handler before exiting, once no more connections are accepted and readonly mode is set.
+// It flushes the set buffer until the write requests started before readonly mode are done and every buffered
+// item went through a batch, or the timeout passes, and closes the Cassandra session.
+// Reads still served on open connections don't delay it. It returns the number of items not written.
+func Drain(timeout time.Duration) int64 {
+	h := singleton
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	lost := h.drain(deadline.C)
+	h.session.Close()
+
+	switch {
+	case lost == 0:
+		log.Println("[INFO] Write buffer fully flushed")
+	case h.wal != nil:
+		log.Println("[WARN] Drain timeout reached,", lost, "buffered items not written to Cassandra, they will be replayed from the WAL")
+	default:
+		log.Println("[ERROR] Drain timeout reached,", lost, "buffered items lost")
+	}
+	return lost
+}
+
+// drain flushes the buffer until no write request is in flight and every buffered item is written, or deadline fires.
+// Deletes are still served in readonly mode, they're refused once the buffer is drained so the session can be closed.
+func (h *Handler) drain(deadline <-chan time.Time) int64 {
+	log.Println("[INFO] Flushing write buffer before exiting")
+	for {
+		if atomic.LoadInt64(&h.requests) == 0 && atomic.LoadInt64(&h.unwritten) == 0 {
+			// Check again for a delete started before deletes were refused
+			if atomic.CompareAndSwapInt32(&h.closing, 0, 1) {
+				continue
+			}
+			return 0
+		}
+
+		done := make(chan struct{})
+		select {
+		case h.flushreq <- done:
+		case <-deadline:
+			return atomic.LoadInt64(&h.unwritten)
+		}
+		select {
+		case <-done:
+		case <-deadline:
+			return atomic.LoadInt64(&h.unwritten)
+		}
+
+		// Requests may still be waiting for room in the buffer or for Cassandra,
+		// and items be in batches queued before the flush
+		if atomic.LoadInt64(&h.requests) > 0 || atomic.LoadInt64(&h.unwritten) > 0 {
+			select {
+			case <-deadline:
+				return atomic.LoadInt64(&h.unwritten)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+}
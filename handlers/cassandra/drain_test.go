@@ -0,0 +1,73 @@
+package cassandra
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+// drainHandler returns a handler whose flushes write written items out of the buffered ones
+func drainHandler(buffered, written int64) (*Handler, *int64) {
+	h := &Handler{flushreq: make(chan chan struct{})}
+	h.unwritten = buffered
+	var flushes int64
+	go func() {
+		for done := range h.flushreq {
+			atomic.AddInt64(&flushes, 1)
+			atomic.AddInt64(&h.unwritten, -written)
+			close(done)
+		}
+	}()
+	return h, &flushes
+}
+
+func TestDrain(t *testing.T) {
+	t.Run("Flushed", func(t *testing.T) {
+		h, flushes := drainHandler(3, 1)
+		if lost := h.drain(time.After(time.Second)); lost != 0 {
+			t.Fatalf("Expected every buffered item to be written, %d lost", lost)
+		}
+		if n := atomic.LoadInt64(flushes); n != 3 {
+			t.Fatalf("Expected the buffer to be flushed until empty, got %d flushes", n)
+		}
+	})
+
+	t.Run("RequestInFlight", func(t *testing.T) {
+		h, flushes := drainHandler(0, 0)
+		done := h.request()
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			done()
+		}()
+		if lost := h.drain(time.After(time.Second)); lost != 0 {
+			t.Fatalf("Expected no item lost, got %d", lost)
+		}
+		if atomic.LoadInt64(&h.requests) != 0 || atomic.LoadInt64(flushes) < 2 {
+			t.Fatalf("Expected the buffer to be flushed while waiting for the request in flight")
+		}
+	})
+
+	t.Run("RefuseWrites", func(t *testing.T) {
+		h, _ := drainHandler(0, 0)
+		h.pending = newPendingIndex()
+		atomic.StoreInt32(&h.readonlymode, 1)
+		if err := h.Set(common.SetRequest{Key: []byte("key"), Data: []byte("foo")}); err != common.ErrItemNotStored {
+			t.Fatalf("Expected set to be refused in readonly mode, got %v", err)
+		}
+		if lost := h.drain(time.After(time.Second)); lost != 0 {
+			t.Fatalf("Expected no item lost, got %d", lost)
+		}
+		if err := h.Delete(common.DeleteRequest{Key: []byte("key")}); err != common.ErrTempFailure {
+			t.Fatalf("Expected delete to be refused once drained, got %v", err)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		h, _ := drainHandler(5, 0)
+		if lost := h.drain(time.After(50 * time.Millisecond)); lost != 5 {
+			t.Fatalf("Expected 5 items lost on timeout, got %d", lost)
+		}
+	})
+}
@@ -0,0 +1,43 @@
+package cassandra
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gocql/gocql"
+	"github.com/netflix/rend/common"
+)
+
+// Cassandra "Invalid" error code, not exported by gocql
+const errCodeInvalid = 0x2200
+
+// errCassandraDown is the error of batches spilled without being tried while Cassandra is unreachable
+var errCassandraDown = errors.New("Cassandra is unreachable")
+
+// backendError maps a Cassandra error to the memcached error sent back to clients.
+// Transient failures (timeouts, unavailable replicas, lost connections) may succeed
+// if retried later, anything else is reported as an internal error.
+func backendError(err error) error {
+	switch err.(type) {
+	case *gocql.RequestErrUnavailable, *gocql.RequestErrWriteTimeout, *gocql.RequestErrReadTimeout:
+		return common.ErrTempFailure
+	}
+
+	switch err {
+	case gocql.ErrTimeoutNoResponse,
+		gocql.ErrTooManyTimeouts,
+		gocql.ErrConnectionClosed,
+		gocql.ErrNoStreams,
+		gocql.ErrNoConnections,
+		gocql.ErrUnavailable,
+		errCassandraDown:
+		return common.ErrTempFailure
+	}
+	return common.ErrInternal
+}
+
+// isBatchTooLarge tells if Cassandra rejected a batch because it exceeds batch_size_fail_threshold_in_kb
+func isBatchTooLarge(err error) bool {
+	reqErr, ok := err.(gocql.RequestError)
+	return ok && reqErr.Code() == errCodeInvalid && strings.Contains(reqErr.Message(), "Batch too large")
+}
@@ -0,0 +1,44 @@
+package cassandra
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gocql/gocql"
+	"github.com/netflix/rend/common"
+)
+
+func TestBackendError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected error
+	}{
+		{gocql.ErrTimeoutNoResponse, common.ErrTempFailure},
+		{gocql.ErrNoConnections, common.ErrTempFailure},
+		{&gocql.RequestErrWriteTimeout{}, common.ErrTempFailure},
+		{&gocql.RequestErrUnavailable{}, common.ErrTempFailure},
+		{&gocql.RequestErrWriteFailure{}, common.ErrInternal},
+		{errors.New("boom"), common.ErrInternal},
+	}
+
+	for _, tt := range tests {
+		if err := backendError(tt.err); err != tt.expected {
+			t.Errorf("backendError(%v) = %v, expected %v", tt.err, err, tt.expected)
+		}
+	}
+}
+
+func TestMissOnError(t *testing.T) {
+	errorMode := &Handler{}
+	missMode := &Handler{missonerror: true}
+
+	if !errorMode.missOnError(gocql.ErrNotFound) || !missMode.missOnError(gocql.ErrNotFound) {
+		t.Errorf("Expected a key not found to be a miss in both modes")
+	}
+	if errorMode.missOnError(gocql.ErrTimeoutNoResponse) {
+		t.Errorf("Expected a timeout not to be a miss in error mode")
+	}
+	if !missMode.missOnError(gocql.ErrTimeoutNoResponse) {
+		t.Errorf("Expected a timeout to be a miss in miss mode")
+	}
+}
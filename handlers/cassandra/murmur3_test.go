@@ -0,0 +1,35 @@
+package cassandra
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestMurmur3Token(t *testing.T) {
+	// Expected tokens were computed by Cassandra Murmur3Partitioner
+	tests := []struct {
+		key      string
+		expected uint64
+	}{
+		{"", 0x0000000000000000},
+		{"0", 0x2ac9debed546a380},
+		{"01234567", 0x8236039b7387354d},
+		{"012345678", 0x4c1e87519fe738ba},
+		{"0123456789012345", 0xa3293ad698ecb99a},
+		{"0123456789012345678", 0x2d0338c1ca87d132},
+		{"hello", 0xcbd8a7b341bd9b02},
+		{"The quick brown fox jumps over the lazy dog.", 0xcd99481f9ee902c9},
+	}
+
+	for _, tt := range tests {
+		if token := murmur3Token([]byte(tt.key)); token != int64(tt.expected) {
+			t.Errorf("Expected token %d for key %q, got %d", int64(tt.expected), tt.key, token)
+		}
+	}
+
+	// Tail bytes above 0x7f are sign extended
+	key, _ := hex.DecodeString("00104327529fb645dd00b883ec39ae448bb800000400066a6b00")
+	if token := murmur3Token(key); token != -9223371632693506265 {
+		t.Errorf("Expected token %d, got %d", int64(-9223371632693506265), token)
+	}
+}
@@ -0,0 +1,123 @@
+package cassandra
+
+import (
+	"sync"
+	"time"
+)
+
+// pendingWrite is the latest acknowledged write of a key, which may not be committed in Cassandra yet.
+type pendingWrite struct {
+	seq      uint64
+	item     CassandraSet
+	deleted  bool
+	deadline time.Time // zero if the item never expires
+}
+
+// expired tells if the pending write TTL is already over
+func (w pendingWrite) expired(now time.Time) bool {
+	return !w.deadline.IsZero() && !now.Before(w.deadline)
+}
+
+// ttl returns the remaining TTL of the pending write in seconds, 0 meaning it never expires
+func (w pendingWrite) ttl(now time.Time) uint32 {
+	if w.deadline.IsZero() {
+		return 0
+	}
+	return uint32((w.deadline.Sub(now) + time.Second - 1) / time.Second)
+}
+
+// pendingIndex indexes acknowledged writes by key until they are committed in Cassandra,
+// so a client always reads its own writes even while they are waiting in the set buffer.
+// Every write gets a sequence number, a committed write is only removed from the index
+// if it has not been superseded by a newer write of the same key.
+// Sequence numbers are strictly increasing timestamps in microseconds, also used as the
+// Cassandra write timestamp of buffered items so concurrent batches can't reorder writes.
+type pendingIndex struct {
+	sync.Mutex
+	seq    uint64
+	writes map[string]pendingWrite
+}
+
+func newPendingIndex() *pendingIndex {
+	return &pendingIndex{
+		writes: make(map[string]pendingWrite),
+	}
+}
+
+// set records a buffered write (or deletion) and returns its sequence number.
+// A new sequence number is given to the item unless it already has one.
+func (p *pendingIndex) set(item CassandraSet) uint64 {
+	w := pendingWrite{item: item, seq: item.seq, deleted: item.Deleted}
+	if item.Exptime > 0 {
+		w.deadline = time.Now().Add(time.Duration(item.Exptime) * time.Second)
+	}
+	return p.record(string(item.Key), w)
+}
+
+// delete records a pending deletion and returns its sequence number,
+// along with the write of the key it supersedes, if any.
+func (p *pendingIndex) delete(key []byte) (uint64, pendingWrite, bool) {
+	w := pendingWrite{
+		seq:     p.next(),
+		item:    CassandraSet{Key: key},
+		deleted: true,
+	}
+	p.Lock()
+	defer p.Unlock()
+	prev, ok := p.writes[string(key)]
+	if !ok || prev.seq < w.seq {
+		p.writes[string(key)] = w
+	}
+	return w.seq, prev, ok
+}
+
+// next returns a new sequence number
+func (p *pendingIndex) next() uint64 {
+	now := uint64(time.Now().UnixNano() / int64(time.Microsecond))
+	p.Lock()
+	defer p.Unlock()
+	if now > p.seq {
+		p.seq = now
+	} else {
+		p.seq++
+	}
+	return p.seq
+}
+
+// record indexes a write, unless a newer write of the same key is already indexed
+func (p *pendingIndex) record(key string, w pendingWrite) uint64 {
+	if w.seq == 0 {
+		w.seq = p.next()
+	}
+	p.Lock()
+	if cur, ok := p.writes[key]; !ok || cur.seq < w.seq {
+		p.writes[key] = w
+	}
+	p.Unlock()
+	return w.seq
+}
+
+// lookup returns the latest pending write of a key, if any
+func (p *pendingIndex) lookup(key []byte) (pendingWrite, bool) {
+	p.Lock()
+	w, ok := p.writes[string(key)]
+	p.Unlock()
+	return w, ok
+}
+
+// commit forgets the write of a key once it reached Cassandra,
+// unless a newer write of the same key is still pending.
+func (p *pendingIndex) commit(key []byte, seq uint64) {
+	p.Lock()
+	if w, ok := p.writes[string(key)]; ok && w.seq == seq {
+		delete(p.writes, string(key))
+	}
+	p.Unlock()
+}
+
+// len returns the number of keys with a pending write
+func (p *pendingIndex) len() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.writes)
+}
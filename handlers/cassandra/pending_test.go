@@ -0,0 +1,115 @@
+package cassandra
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPendingIndex(t *testing.T) {
+	t.Run("SetLookupCommit", func(t *testing.T) {
+		p := newPendingIndex()
+		seq := p.set(CassandraSet{Key: []byte("key"), Data: []byte("foo"), Flags: 42})
+
+		w, ok := p.lookup([]byte("key"))
+		if !ok {
+			t.Fatalf("Expected a pending write for 'key'")
+		}
+		if w.deleted || string(w.item.Data) != "foo" || w.item.Flags != 42 {
+			t.Fatalf("Unexpected pending write %#v", w)
+		}
+
+		p.commit([]byte("key"), seq)
+		if _, ok := p.lookup([]byte("key")); ok {
+			t.Fatalf("Expected no pending write after commit")
+		}
+	})
+
+	t.Run("CommitSuperseded", func(t *testing.T) {
+		p := newPendingIndex()
+		seq1 := p.set(CassandraSet{Key: []byte("key"), Data: []byte("foo")})
+		seq2 := p.set(CassandraSet{Key: []byte("key"), Data: []byte("bar")})
+
+		p.commit([]byte("key"), seq1)
+		w, ok := p.lookup([]byte("key"))
+		if !ok || string(w.item.Data) != "bar" {
+			t.Fatalf("Expected newest pending write to survive an older commit, got %#v", w)
+		}
+
+		p.commit([]byte("key"), seq2)
+		if p.len() != 0 {
+			t.Fatalf("Expected an empty index, got %d keys", p.len())
+		}
+	})
+
+	t.Run("SeqIncreasing", func(t *testing.T) {
+		p := newPendingIndex()
+		before := uint64(time.Now().UnixNano() / int64(time.Microsecond))
+		prev := p.set(CassandraSet{Key: []byte("key")})
+		if prev < before {
+			t.Fatalf("Expected sequence number to be a timestamp after %d, got %d", before, prev)
+		}
+		for i := 0; i < 1000; i++ {
+			seq := p.set(CassandraSet{Key: []byte("key")})
+			if seq <= prev {
+				t.Fatalf("Expected sequence number %d to be greater than %d", seq, prev)
+			}
+			prev = seq
+		}
+	})
+
+	t.Run("OutOfOrder", func(t *testing.T) {
+		p := newPendingIndex()
+		older := p.next()
+		p.set(CassandraSet{Key: []byte("key"), Data: []byte("new")})
+		p.set(CassandraSet{Key: []byte("key"), Data: []byte("old"), seq: older})
+
+		w, _ := p.lookup([]byte("key"))
+		if string(w.item.Data) != "new" {
+			t.Fatalf("Expected an older write not to replace a newer one, got %q", w.item.Data)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		p := newPendingIndex()
+		p.set(CassandraSet{Key: []byte("key"), Data: []byte("foo")})
+		seq, prev, ok := p.delete([]byte("key"))
+		if !ok || prev.deleted || string(prev.item.Data) != "foo" {
+			t.Fatalf("Expected the deletion to supersede the pending write, got %#v", prev)
+		}
+
+		w, ok := p.lookup([]byte("key"))
+		if !ok || !w.deleted || w.seq != seq {
+			t.Fatalf("Expected a pending deletion, got %#v", w)
+		}
+		if seq <= prev.seq {
+			t.Fatalf("Expected the deletion sequence number %d to be greater than %d", seq, prev.seq)
+		}
+
+		if _, _, ok := p.delete([]byte("other")); ok {
+			t.Fatalf("Expected no pending write superseded for 'other'")
+		}
+	})
+
+	t.Run("Expiration", func(t *testing.T) {
+		p := newPendingIndex()
+		p.set(CassandraSet{Key: []byte("forever")})
+		p.set(CassandraSet{Key: []byte("key"), Exptime: 10})
+		now := time.Now()
+
+		w, _ := p.lookup([]byte("forever"))
+		if w.expired(now.Add(time.Hour)) || w.ttl(now) != 0 {
+			t.Fatalf("Expected a write without TTL to never expire, got %#v", w)
+		}
+
+		w, _ = p.lookup([]byte("key"))
+		if w.expired(now) {
+			t.Fatalf("Expected write not to be expired yet")
+		}
+		if ttl := w.ttl(now); ttl != 10 {
+			t.Fatalf("Expected remaining TTL to be 10, got %d", ttl)
+		}
+		if !w.expired(now.Add(11 * time.Second)) {
+			t.Fatalf("Expected write to be expired after its TTL")
+		}
+	})
+}
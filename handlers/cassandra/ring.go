@@ -0,0 +1,157 @@
+package cassandra
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gocql/gocql"
+)
+
+// tokenRing maps Murmur3Partitioner tokens to the host owning them
+type tokenRing struct {
+	tokens []int64
+	hosts  []*gocql.HostInfo
+}
+
+// add registers the tokens of a host, the ring must be sorted before use
+func (t *tokenRing) add(host *gocql.HostInfo, tokens []string) {
+	for _, tok := range tokens {
+		v, err := strconv.ParseInt(tok, 10, 64)
+		if err != nil {
+			continue
+		}
+		t.tokens = append(t.tokens, v)
+		t.hosts = append(t.hosts, host)
+	}
+}
+
+func (t *tokenRing) Len() int           { return len(t.tokens) }
+func (t *tokenRing) Less(i, j int) bool { return t.tokens[i] < t.tokens[j] }
+func (t *tokenRing) Swap(i, j int) {
+	t.tokens[i], t.tokens[j] = t.tokens[j], t.tokens[i]
+	t.hosts[i], t.hosts[j] = t.hosts[j], t.hosts[i]
+}
+
+// owner returns the primary replica of a token : the host of the first token not lower than it
+func (t *tokenRing) owner(token int64) *gocql.HostInfo {
+	i := sort.Search(len(t.tokens), func(i int) bool { return t.tokens[i] >= token })
+	if i == len(t.tokens) {
+		i = 0
+	}
+	return t.hosts[i]
+}
+
+// batchRouter is a token aware host selection policy which can also route batches.
+// gocql doesn't compute a routing key for batches, so the owner of the keys of a batch is
+// registered before executing it, and tried first when the batch is sent.
+type batchRouter struct {
+	gocql.HostSelectionPolicy // token aware policy, used for queries and unrouted batches
+
+	mu          sync.RWMutex
+	partitioner string
+	hosts       map[string]*gocql.HostInfo
+	ring        *tokenRing
+
+	routes sync.Map // *gocql.Batch -> *gocql.HostInfo
+}
+
+func newBatchRouter() *batchRouter {
+	return &batchRouter{
+		HostSelectionPolicy: gocql.TokenAwareHostPolicy(gocql.RoundRobinHostPolicy()),
+		hosts:               make(map[string]*gocql.HostInfo),
+	}
+}
+
+func (r *batchRouter) SetPartitioner(partitioner string) {
+	r.HostSelectionPolicy.SetPartitioner(partitioner)
+	r.mu.Lock()
+	r.partitioner = partitioner
+	r.resetRing()
+	r.mu.Unlock()
+}
+
+func (r *batchRouter) AddHost(host *gocql.HostInfo) {
+	r.HostSelectionPolicy.AddHost(host)
+	r.addHost(host)
+}
+
+func (r *batchRouter) HostUp(host *gocql.HostInfo) {
+	r.HostSelectionPolicy.HostUp(host)
+	r.addHost(host)
+}
+
+func (r *batchRouter) RemoveHost(host *gocql.HostInfo) {
+	r.HostSelectionPolicy.RemoveHost(host)
+	r.mu.Lock()
+	delete(r.hosts, host.ConnectAddress().String())
+	r.resetRing()
+	r.mu.Unlock()
+}
+
+func (r *batchRouter) addHost(host *gocql.HostInfo) {
+	r.mu.Lock()
+	r.hosts[host.ConnectAddress().String()] = host
+	r.resetRing()
+	r.mu.Unlock()
+}
+
+// resetRing rebuilds the token ring from known hosts, it must be called with the lock held
+func (r *batchRouter) resetRing() {
+	if !strings.HasSuffix(r.partitioner, "Murmur3Partitioner") {
+		r.ring = nil
+		return
+	}
+	ring := &tokenRing{}
+	for _, host := range r.hosts {
+		ring.add(host, host.Tokens())
+	}
+	sort.Sort(ring)
+	r.ring = ring
+}
+
+// owner returns the primary replica of a key, or nil if the token ring is unknown
+func (r *batchRouter) owner(key []byte) *gocql.HostInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.ring == nil || r.ring.Len() == 0 {
+		return nil
+	}
+	return r.ring.owner(murmur3Token(key))
+}
+
+// Pick tries the registered owner of a batch first, then any host chosen by the token aware policy
+func (r *batchRouter) Pick(qry gocql.ExecutableQuery) gocql.NextHost {
+	next := r.HostSelectionPolicy.Pick(qry)
+	b, ok := qry.(*gocql.Batch)
+	if !ok {
+		return next
+	}
+	route, ok := r.routes.Load(b)
+	if !ok {
+		return next
+	}
+
+	owner := route.(*gocql.HostInfo)
+	tried := !owner.IsUp()
+	return func() gocql.SelectedHost {
+		if !tried {
+			tried = true
+			return routedHost{owner}
+		}
+		for {
+			host := next()
+			if host == nil || !host.Info().ConnectAddress().Equal(owner.ConnectAddress()) {
+				return host
+			}
+		}
+	}
+}
+
+type routedHost struct {
+	info *gocql.HostInfo
+}
+
+func (h routedHost) Info() *gocql.HostInfo { return h.info }
+func (h routedHost) Mark(err error)        {}
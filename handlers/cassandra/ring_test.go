@@ -0,0 +1,39 @@
+package cassandra
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/gocql/gocql"
+)
+
+func TestTokenRingOwner(t *testing.T) {
+	host1 := &gocql.HostInfo{}
+	host2 := &gocql.HostInfo{}
+
+	ring := &tokenRing{}
+	ring.add(host1, []string{"-100", "100"})
+	ring.add(host2, []string{"0", "not-a-token"})
+	sort.Sort(ring)
+
+	if ring.Len() != 3 {
+		t.Fatalf("Expected 3 tokens in ring, got %d", ring.Len())
+	}
+
+	tests := []struct {
+		token int64
+		owner *gocql.HostInfo
+	}{
+		{-1000, host1},
+		{-100, host1},
+		{-99, host2},
+		{0, host2},
+		{50, host1},
+		{101, host1}, // wraps around the ring
+	}
+	for _, tt := range tests {
+		if owner := ring.owner(tt.token); owner != tt.owner {
+			t.Errorf("Unexpected owner of token %d", tt.token)
+		}
+	}
+}
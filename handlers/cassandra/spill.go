@@ -0,0 +1,279 @@
+package cassandra
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+	"github.com/spf13/viper"
+)
+
+// Spill queue metrics
+var (
+	MetricSpillBacklogItems = metrics.AddIntGauge("spill_backlog_items", nil)
+	MetricSpillBacklogBytes = metrics.AddIntGauge("spill_backlog_bytes", nil)
+	MetricSpillItems        = metrics.AddCounter("spill_items", nil)
+	MetricSpillReplayed     = metrics.AddCounter("spill_replayed_items", nil)
+	MetricSpillRejected     = metrics.AddCounter("spill_rejected_items", nil)
+	MetricSpillErrors       = metrics.AddCounter("spill_errors", nil)
+)
+
+// spillSegmentSize is the size after which a new spill segment is started,
+// a segment is only replayed once it's not written anymore.
+const spillSegmentSize = 16 * 1024 * 1024
+
+type spillSegment struct {
+	id    uint64
+	items int
+	bytes int64
+}
+
+// spillQueue is a bounded on-disk queue of the batches which couldn't be written while Cassandra
+// was unreachable. Segments use the WAL record format, and are replayed in order once Cassandra
+// is back. From a spill until the replay of a batch succeeds, Cassandra is considered down and
+// batches are spilled right away instead of waiting for their retries to fail.
+type spillQueue struct {
+	sync.Mutex
+	dir      string
+	maxBytes int64
+
+	segments    []spillSegment // oldest first, the last one is written
+	active      *os.File
+	bytes       int64
+	items       int
+	unreachable bool
+}
+
+func spillSegmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("spill-%016d.log", id))
+}
+
+// openSpillQueue opens the spill queue in dir, with the segments left by a previous run
+func openSpillQueue(dir string, maxBytes int64) (*spillQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "spill-*.log"))
+	if err != nil {
+		return nil, err
+	}
+
+	q := &spillQueue{
+		dir:      dir,
+		maxBytes: maxBytes,
+	}
+	for _, path := range paths {
+		var seg spillSegment
+		if _, err := fmt.Sscanf(filepath.Base(path), "spill-%d.log", &seg.id); err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		items, _ := readWALSegment(path, time.Time{})
+		seg.items = len(items)
+		seg.bytes = info.Size()
+		q.segments = append(q.segments, seg)
+		q.items += seg.items
+		q.bytes += seg.bytes
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i].id < q.segments[j].id })
+	q.unreachable = q.items > 0
+	q.updateGauges()
+	return q, nil
+}
+
+// down tells if Cassandra is considered unreachable
+func (q *spillQueue) down() bool {
+	if q == nil {
+		return false
+	}
+	q.Lock()
+	defer q.Unlock()
+	return q.unreachable
+}
+
+// up records that Cassandra is reachable again
+func (q *spillQueue) up() {
+	q.Lock()
+	if q.unreachable {
+		log.Println("[INFO] Cassandra is reachable again, stopping to spill batches")
+	}
+	q.unreachable = false
+	q.Unlock()
+}
+
+// push appends items to the queue, it returns false if the queue is disabled, full or can't be written
+func (q *spillQueue) push(items []CassandraSet) bool {
+	if q == nil {
+		return false
+	}
+
+	var records []byte
+	for _, item := range items {
+		records = append(records, encodeWALRecord(item)...)
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	if q.bytes+int64(len(records)) > q.maxBytes {
+		metrics.IncCounterBy(MetricSpillRejected, uint64(len(items)))
+		log.Println("[ERROR] Spill queue is full, unable to spill", len(items), "items")
+		return false
+	}
+	if q.active == nil || q.segments[len(q.segments)-1].bytes >= spillSegmentSize {
+		if err := q.rotate(); err != nil {
+			metrics.IncCounter(MetricSpillErrors)
+			log.Println("[ERROR] Unable to start a spill segment. ", err)
+			return false
+		}
+	}
+	if _, err := q.active.Write(records); err != nil {
+		metrics.IncCounter(MetricSpillErrors)
+		log.Println("[ERROR] Unable to spill items. ", err)
+		return false
+	}
+	if err := q.active.Sync(); err != nil {
+		metrics.IncCounter(MetricSpillErrors)
+		log.Println("[ERROR] Unable to sync spill segment. ", err)
+		return false
+	}
+
+	if !q.unreachable {
+		log.Println("[WARN] Cassandra is unreachable, spilling batches to", q.dir)
+	}
+	q.unreachable = true
+	seg := &q.segments[len(q.segments)-1]
+	seg.items += len(items)
+	seg.bytes += int64(len(records))
+	q.items += len(items)
+	q.bytes += int64(len(records))
+	metrics.IncCounterBy(MetricSpillItems, uint64(len(items)))
+	q.updateGauges()
+	return true
+}
+
+// rotate closes the written segment and starts a new one, it must be called with the lock held
+func (q *spillQueue) rotate() error {
+	if q.active != nil {
+		q.active.Close()
+		q.active = nil
+	}
+	var id uint64 = 1
+	if len(q.segments) > 0 {
+		id = q.segments[len(q.segments)-1].id + 1
+	}
+	f, err := os.OpenFile(spillSegmentPath(q.dir, id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	q.active = f
+	q.segments = append(q.segments, spillSegment{id: id})
+	return nil
+}
+
+// oldest returns the oldest segment holding items, the written segment is closed before
+// being returned so items spilled from now on go to a new one.
+func (q *spillQueue) oldest() (spillSegment, bool) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.segments) == 0 {
+		return spillSegment{}, false
+	}
+	if len(q.segments) == 1 && q.active != nil {
+		if q.segments[0].items == 0 {
+			return spillSegment{}, false
+		}
+		q.active.Close()
+		q.active = nil
+	}
+	return q.segments[0], true
+}
+
+// remove deletes the oldest segment once replayed
+func (q *spillQueue) remove(seg spillSegment) {
+	q.Lock()
+	defer q.Unlock()
+	if err := os.Remove(spillSegmentPath(q.dir, seg.id)); err != nil && !os.IsNotExist(err) {
+		metrics.IncCounter(MetricSpillErrors)
+		log.Println("[ERROR] Unable to remove spill segment. ", err)
+	}
+	q.segments = q.segments[1:]
+	q.items -= seg.items
+	q.bytes -= seg.bytes
+	q.updateGauges()
+}
+
+func (q *spillQueue) updateGauges() {
+	metrics.SetIntGauge(MetricSpillBacklogItems, uint64(q.items))
+	metrics.SetIntGauge(MetricSpillBacklogBytes, uint64(q.bytes))
+}
+
+// spillReplayLoop drains the spill queue to Cassandra, oldest segment first. Items are written
+// with their original timestamp, so they never overwrite a newer write of the same key, and
+// with what remains of their TTL. A segment failing to be written is retried on the next round.
+func (h *Handler) spillReplayLoop() {
+	maxBytes := viper.GetInt("CassandraBatchMaxBytes")
+	maxItems := viper.GetInt("CassandraBatchMaxItemSize")
+	if maxItems < 1 {
+		maxItems = 1
+	}
+
+	for range time.Tick(viper.GetDuration("CassandraSpillReplayIntervalMs")) {
+		for {
+			seg, ok := h.spill.oldest()
+			if !ok {
+				break
+			}
+
+			items, err := readWALSegment(spillSegmentPath(h.spill.dir, seg.id), time.Now())
+			if err != nil && err != errWALCorrupted {
+				metrics.IncCounter(MetricSpillErrors)
+				log.Println("[ERROR] Unable to read spill segment. ", err)
+				break
+			}
+			if err == errWALCorrupted {
+				log.Println("[WARN] Spill segment", seg.id, "ends with a corrupted record, replaying", len(items), "items before it")
+			}
+
+			if !h.replaySpilled(items, maxItems, maxBytes) {
+				break
+			}
+			metrics.IncCounterBy(MetricSpillReplayed, uint64(len(items)))
+			h.spill.remove(seg)
+			log.Println("[INFO] Replayed", len(items), "spilled items to Cassandra")
+		}
+	}
+}
+
+// replaySpilled writes spilled items in batches, it returns false if Cassandra is still unreachable.
+// Items failing for any other reason are sent to the dead-letter sink.
+func (h *Handler) replaySpilled(items []CassandraSet, maxItems, maxBytes int) bool {
+	for start := 0; start < len(items); start += maxItems {
+		end := start + maxItems
+		if end > len(items) {
+			end = len(items)
+		}
+		for _, routed := range h.routeBatch(items[start:end]) {
+			for _, job := range splitBatch(routed, maxBytes) {
+				err := h.executeBatch(job.items, job.owner)
+				if err != nil && backendError(err) == common.ErrTempFailure {
+					return false
+				}
+				h.spill.up()
+				if err != nil {
+					h.giveUp(job.items, err)
+				}
+			}
+		}
+	}
+	return true
+}
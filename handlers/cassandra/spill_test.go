@@ -0,0 +1,73 @@
+package cassandra
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSpillQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memandra")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := openSpillQueue(dir, 1024)
+	if err != nil {
+		t.Fatalf("Unable to open spill queue: %v", err)
+	}
+	if q.down() {
+		t.Fatalf("Expected Cassandra not to be considered down with an empty queue")
+	}
+	if _, ok := q.oldest(); ok {
+		t.Fatalf("Expected no segment to replay")
+	}
+
+	now := time.Now()
+	items := []CassandraSet{
+		{Key: []byte("key1"), Data: []byte("foo"), Exptime: 60, seq: 1, buffered: now},
+		{Key: []byte("key2"), Data: []byte("bar"), seq: 2, buffered: now},
+	}
+	if !q.push(items) {
+		t.Fatalf("Unable to spill items")
+	}
+	if !q.down() {
+		t.Fatalf("Expected Cassandra to be considered down once items are spilled")
+	}
+	if q.push([]CassandraSet{{Key: []byte("big"), Data: make([]byte, 1024)}}) {
+		t.Fatalf("Expected a full queue to reject items")
+	}
+
+	// Segments are kept across restarts
+	q, err = openSpillQueue(dir, 1024)
+	if err != nil {
+		t.Fatalf("Unable to reopen spill queue: %v", err)
+	}
+	if !q.down() || q.items != 2 {
+		t.Fatalf("Expected 2 spilled items after reopening, got %d", q.items)
+	}
+
+	seg, ok := q.oldest()
+	if !ok || seg.items != 2 {
+		t.Fatalf("Expected a segment of 2 items to replay, got %#v", seg)
+	}
+	read, err := readWALSegment(spillSegmentPath(dir, seg.id), now)
+	if err != nil || len(read) != 2 || read[0].seq != 1 || read[0].Exptime != 60 {
+		t.Fatalf("Unexpected spilled items %#v (%v)", read, err)
+	}
+	// A replayed item sent to the dead-letter sink expires with what remains of its TTL
+	if !read[0].buffered.Equal(now) {
+		t.Fatalf("Expected spilled items to be read back buffered now, got %v", read[0].buffered)
+	}
+
+	q.up()
+	q.remove(seg)
+	if q.down() || q.items != 0 || q.bytes != 0 {
+		t.Fatalf("Expected an empty queue after replay, got %d items", q.items)
+	}
+	if _, err := os.Stat(spillSegmentPath(dir, seg.id)); !os.IsNotExist(err) {
+		t.Fatalf("Expected replayed segment to be removed")
+	}
+}
@@ -0,0 +1,136 @@
+package cassandra
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gocql/gocql"
+)
+
+// statements holds every CQL query used by the handler.
+// They are built once at startup, gocql then prepares each of them on first use
+// and keeps the prepared statement in its cache, as the query string never changes.
+type statements struct {
+	insert    string // buffered SET, with the item own write timestamp
+	add       string // ADD lightweight transaction
+	replace   string // REPLACE lightweight transaction
+	concat    string // APPEND & PREPEND lightweight transaction
+	retouch   string // TOUCH & GAT lightweight transaction
+	get       string
+	getE      string
+	read      string // value read before a TOUCH or GAT
+	readTTL   string // value read before an APPEND or PREPEND
+	writetime string // existence check of the buffered REPLACE
+	delete    string // DELETE, with a write timestamp after every buffered write of the key
+	deleteLWT string // DELETE lightweight transaction
+}
+
+// buildStatements renders all handler queries for the given table
+func buildStatements(keyspace, bucket string, flagscol bool) statements {
+	table := keyspace + "." + bucket
+
+	// flagscol is skipped on tables lacking it
+	columns := "valuecol"
+	markers := "?"
+	assignments := "valuecol=?"
+	if flagscol {
+		columns = "valuecol,flagscol"
+		markers = "?, ?"
+		assignments = "valuecol=?, flagscol=?"
+	}
+
+	// A key exists as long as its value does : an update with a shorter TTL than the insert creating
+	// the row leaves the row alive (without value) once the value expired, so lightweight transactions
+	// check valuecol instead of the row existence.
+	return statements{
+		insert:    fmt.Sprintf("INSERT INTO %s (keycol,%s) VALUES (?, %s) USING TTL ? AND TIMESTAMP ?", table, columns, markers),
+		add:       fmt.Sprintf("UPDATE %s USING TTL ? SET %s WHERE keycol=? IF valuecol=null", table, assignments),
+		replace:   fmt.Sprintf("UPDATE %s USING TTL ? SET %s WHERE keycol=? IF valuecol!=null", table, assignments),
+		concat:    fmt.Sprintf("UPDATE %s USING TTL ? SET valuecol=? WHERE keycol=? IF valuecol=?", table),
+		retouch:   fmt.Sprintf("UPDATE %s USING TTL ? SET %s WHERE keycol=? IF valuecol=?", table, assignments),
+		get:       fmt.Sprintf("SELECT keycol,%s FROM %s WHERE keycol=?", columns, table),
+		getE:      fmt.Sprintf("SELECT keycol,%s,TTL(valuecol) FROM %s WHERE keycol=?", columns, table),
+		read:      fmt.Sprintf("SELECT %s FROM %s WHERE keycol=?", columns, table),
+		readTTL:   fmt.Sprintf("SELECT valuecol,TTL(valuecol) FROM %s WHERE keycol=?", table),
+		writetime: fmt.Sprintf("SELECT writetime(valuecol) FROM %s WHERE keycol=? LIMIT 1", table),
+		delete:    fmt.Sprintf("DELETE FROM %s USING TIMESTAMP ? WHERE keycol=?", table),
+		deleteLWT: fmt.Sprintf("DELETE FROM %s WHERE keycol=? IF valuecol!=null", table),
+	}
+}
+
+// schemaName returns the name of a keyspace or table as stored in the schema,
+// Cassandra lowercases names unless they are double quoted.
+func schemaName(name string) string {
+	if len(name) >= 2 && strings.HasPrefix(name, `"`) && strings.HasSuffix(name, `"`) {
+		return strings.Replace(name[1:len(name)-1], `""`, `"`, -1)
+	}
+	return strings.ToLower(name)
+}
+
+// checkSchema makes sure the bucket table exists with the expected columns before serving any
+// request, so a schema mistake fails at startup instead of on every query.
+// It reports whether the optional flagscol column is available.
+func checkSchema(sess *gocql.Session, keyspace, bucket string) (bool, error) {
+	ks, err := sess.KeyspaceMetadata(schemaName(keyspace))
+	if err != nil {
+		return false, fmt.Errorf("Unable to read Cassandra keyspace %s schema: %v", keyspace, err)
+	}
+	table, ok := ks.Tables[schemaName(bucket)]
+	if !ok {
+		return false, fmt.Errorf("Cassandra table %s.%s does not exist", keyspace, bucket)
+	}
+
+	expected := []struct {
+		name     string
+		typ      gocql.Type
+		required bool
+	}{
+		{"keycol", gocql.TypeBlob, true},
+		{"valuecol", gocql.TypeBlob, true},
+		{"flagscol", gocql.TypeInt, false},
+	}
+	flagscol := true
+	for _, e := range expected {
+		col, ok := table.Columns[e.name]
+		if !ok {
+			if e.required {
+				return false, fmt.Errorf("Cassandra table %s.%s has no %s column", keyspace, bucket, e.name)
+			}
+			flagscol = false
+			continue
+		}
+		if col.Type == nil || col.Type.Type() != e.typ {
+			return false, fmt.Errorf("Cassandra column %s.%s.%s should be of type %s", keyspace, bucket, e.name, e.typ)
+		}
+	}
+	return flagscol, nil
+}
+
+// batchValues returns the values bound to the buffered insert statement
+func (h *Handler) batchValues(item CassandraSet) []interface{} {
+	return append(h.insertValues(item), int64(item.seq))
+}
+
+// batchStatement returns the statement writing a buffered item in a batch, and its values
+func (h *Handler) batchStatement(item CassandraSet) (string, []interface{}) {
+	if item.Deleted {
+		return h.stmts.delete, []interface{}{int64(item.seq), item.Key}
+	}
+	return h.stmts.insert, h.batchValues(item)
+}
+
+// insertValues returns the values bound to the insert statement, before its timestamp
+func (h *Handler) insertValues(item CassandraSet) []interface{} {
+	if h.flagscol {
+		return []interface{}{item.Key, item.Data, item.Flags, item.Exptime}
+	}
+	return []interface{}{item.Key, item.Data, item.Exptime}
+}
+
+// updateValues returns the values bound to the add, replace (or retouch) statement
+func (h *Handler) updateValues(item CassandraSet) []interface{} {
+	if h.flagscol {
+		return []interface{}{item.Exptime, item.Data, item.Flags, item.Key}
+	}
+	return []interface{}{item.Exptime, item.Data, item.Key}
+}
@@ -0,0 +1,41 @@
+package cassandra
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSchemaName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"bucket", "bucket"},
+		{"MyBucket", "mybucket"},
+		{`"MyBucket"`, "MyBucket"},
+		{`"My""Bucket"`, `My"Bucket`},
+		{`"`, `"`},
+	}
+
+	for _, tt := range tests {
+		if name := schemaName(tt.name); name != tt.expected {
+			t.Errorf("schemaName(%q) = %q, expected %q", tt.name, name, tt.expected)
+		}
+	}
+}
+
+// A row outliving its value (an update with a shorter TTL than the insert creating the row) must be missing
+func TestLWTConditions(t *testing.T) {
+	stmts := buildStatements("kvstore", "bucket", true)
+	for name, stmt := range map[string]string{
+		"add":       stmts.add,
+		"replace":   stmts.replace,
+		"retouch":   stmts.retouch,
+		"concat":    stmts.concat,
+		"deleteLWT": stmts.deleteLWT,
+	} {
+		if strings.Contains(stmt, "EXISTS") || !strings.Contains(stmt, " IF valuecol") {
+			t.Errorf("Expected %s statement to be conditioned on valuecol, got %q", name, stmt)
+		}
+	}
+}
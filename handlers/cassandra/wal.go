@@ -0,0 +1,355 @@
+package cassandra
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+	"github.com/spf13/viper"
+)
+
+// Write-ahead log metrics
+var (
+	MetricWALErrors   = metrics.AddCounter("wal_errors", nil)
+	MetricWALReplayed = metrics.AddCounter("wal_replayed_items", nil)
+	MetricWALSegments = metrics.AddIntGauge("wal_segments", nil)
+)
+
+// WAL fsync policies
+const (
+	walSyncAlways   = "always"   // before acknowledging each set
+	walSyncInterval = "interval" // every CassandraWALSyncIntervalMs
+	walSyncNever    = "never"    // left to the OS
+)
+
+const walHeaderSize = 8 // payload length and CRC32
+
+// walDeleted is set in the key length of a buffered deletion record
+const walDeleted = 1 << 31
+
+var errWALCorrupted = errors.New("corrupted WAL record")
+
+// wal is a segmented append-only log of buffered sets. Each record is written before its item
+// enters the set buffer, and a segment is deleted once all its items went through a batch.
+// Records are a payload length and CRC32 header, followed by the item sequence number,
+// its expiration as a unix time (0 if it never expires), its flags, its key length, key and data.
+// The highest bit of the key length marks a buffered deletion.
+type wal struct {
+	sync.Mutex
+	dir         string
+	policy      string
+	segmentSize int64
+
+	active   *os.File
+	activeID uint64
+	size     int64
+	dirty    bool
+	pending  map[uint64]int // segment id -> items not written in Cassandra yet
+}
+
+func walSegmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("wal-%016d.log", id))
+}
+
+// listWALSegments returns the ids of the segments found in dir, in write order
+func listWALSegments(dir string) ([]uint64, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, path := range paths {
+		var id uint64
+		if _, err := fmt.Sscanf(filepath.Base(path), "wal-%d.log", &id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// openWAL starts a new segment after the existing ones, which are left untouched for replay
+func openWAL(dir, policy string, segmentSize int64, syncInterval time.Duration) (*wal, []uint64, error) {
+	switch policy {
+	case walSyncAlways, walSyncInterval, walSyncNever:
+	default:
+		return nil, nil, fmt.Errorf("Unknown WAL sync policy %q", policy)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+	old, err := listWALSegments(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w := &wal{
+		dir:         dir,
+		policy:      policy,
+		segmentSize: segmentSize,
+		pending:     make(map[uint64]int),
+	}
+	if len(old) > 0 {
+		w.activeID = old[len(old)-1]
+	}
+	if err := w.rotate(); err != nil {
+		return nil, nil, err
+	}
+
+	if policy == walSyncInterval {
+		go w.syncLoop(syncInterval)
+	}
+	return w, old, nil
+}
+
+// rotate closes the active segment and starts a new one, it must be called with the lock held
+func (w *wal) rotate() error {
+	if w.active != nil {
+		if err := w.active.Sync(); err != nil {
+			return err
+		}
+		w.active.Close()
+		if w.pending[w.activeID] == 0 {
+			w.remove(w.activeID)
+		}
+	}
+
+	w.activeID++
+	f, err := os.OpenFile(walSegmentPath(w.dir, w.activeID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		w.active = nil
+		return err
+	}
+	w.active = f
+	w.size = 0
+	w.pending[w.activeID] = 0
+	metrics.SetIntGauge(MetricWALSegments, uint64(len(w.pending)))
+	return nil
+}
+
+// remove deletes a segment, it must be called with the lock held
+func (w *wal) remove(id uint64) {
+	delete(w.pending, id)
+	if err := os.Remove(walSegmentPath(w.dir, id)); err != nil && !os.IsNotExist(err) {
+		metrics.IncCounter(MetricWALErrors)
+		log.Println("[ERROR] Unable to remove WAL segment. ", err)
+	}
+	metrics.SetIntGauge(MetricWALSegments, uint64(len(w.pending)))
+}
+
+// encodeWALRecord returns the log record of an item
+func encodeWALRecord(item CassandraSet) []byte {
+	payload := make([]byte, 24+len(item.Key)+len(item.Data))
+	binary.BigEndian.PutUint64(payload[0:], item.seq)
+	if item.Exptime > 0 {
+		binary.BigEndian.PutUint64(payload[8:], uint64(item.buffered.Add(time.Duration(item.Exptime)*time.Second).Unix()))
+	}
+	binary.BigEndian.PutUint32(payload[16:], item.Flags)
+	keylen := uint32(len(item.Key))
+	if item.Deleted {
+		keylen |= walDeleted
+	}
+	binary.BigEndian.PutUint32(payload[20:], keylen)
+	copy(payload[24:], item.Key)
+	copy(payload[24+len(item.Key):], item.Data)
+
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	copy(record[walHeaderSize:], payload)
+	return record
+}
+
+// append logs an item and records its segment in the item
+func (w *wal) append(item *CassandraSet) error {
+	record := encodeWALRecord(*item)
+
+	w.Lock()
+	defer w.Unlock()
+
+	if w.active == nil {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := w.active.Write(record); err != nil {
+		return err
+	}
+	if w.policy == walSyncAlways {
+		if err := w.active.Sync(); err != nil {
+			return err
+		}
+	} else {
+		w.dirty = true
+	}
+
+	item.walseg = w.activeID
+	w.pending[w.activeID]++
+	w.size += int64(len(record))
+	if w.size >= w.segmentSize {
+		if err := w.rotate(); err != nil {
+			metrics.IncCounter(MetricWALErrors)
+			log.Println("[ERROR] Unable to rotate WAL segment. ", err)
+		}
+	}
+	return nil
+}
+
+// replayWAL opens the write-ahead log in dir, and pushes the sets (and deletions) logged by a previous run
+// back to the set buffer. They are logged again in the new segments before the old ones are deleted.
+func (h *Handler) replayWAL(dir string) error {
+	w, old, err := openWAL(
+		dir,
+		viper.GetString("CassandraWALSync"),
+		viper.GetInt64("CassandraWALSegmentSize"),
+		viper.GetDuration("CassandraWALSyncIntervalMs"),
+	)
+	if err != nil {
+		return err
+	}
+	h.wal = w
+
+	now := time.Now()
+	replayed := 0
+	for _, id := range old {
+		items, err := readWALSegment(walSegmentPath(dir, id), now)
+		if err == errWALCorrupted {
+			log.Println("[WARN] WAL segment", id, "ends with a corrupted record, replaying", len(items), "sets before it")
+		} else if err != nil {
+			return err
+		}
+
+		for _, item := range items {
+			h.slots <- struct{}{}
+			if err := h.wal.append(&item); err != nil {
+				return err
+			}
+			h.pending.set(item)
+			h.buffered(item)
+			h.setbuffer <- item
+		}
+		replayed += len(items)
+	}
+
+	metrics.IncCounterBy(MetricWALReplayed, uint64(replayed))
+	w.drop(old)
+	if len(old) > 0 {
+		log.Println("[INFO] Replayed", replayed, "sets from the WAL")
+	}
+	return nil
+}
+
+// release forgets an item once it went through a batch,
+// its segment is deleted as soon as all its items are released.
+func (w *wal) release(item CassandraSet) {
+	if w == nil || item.walseg == 0 {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.pending[item.walseg]--
+	if w.pending[item.walseg] <= 0 && item.walseg != w.activeID {
+		w.remove(item.walseg)
+	}
+}
+
+// drop deletes the segments left by a previous run once they are replayed
+func (w *wal) drop(ids []uint64) {
+	w.Lock()
+	defer w.Unlock()
+	for _, id := range ids {
+		w.remove(id)
+	}
+}
+
+func (w *wal) syncLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		w.Lock()
+		if w.dirty && w.active != nil {
+			if err := w.active.Sync(); err != nil {
+				metrics.IncCounter(MetricWALErrors)
+				log.Println("[ERROR] Unable to sync WAL segment. ", err)
+			}
+			w.dirty = false
+		}
+		w.Unlock()
+	}
+}
+
+// readWALSegment returns the items logged in a segment. Reading stops at the first truncated or
+// corrupted record, which is expected for the last record written before a crash. A record length
+// is never trusted beyond the end of the segment.
+// Items already expired are skipped, the TTL of others is what remains of their original TTL,
+// counted from now as their buffered time.
+func readWALSegment(path string, now time.Time) ([]CassandraSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var items []CassandraSet
+	r := bufio.NewReader(f)
+	header := make([]byte, walHeaderSize)
+	remaining := info.Size()
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return items, nil
+			}
+			return items, errWALCorrupted
+		}
+		remaining -= walHeaderSize
+
+		// A corrupted length must not be allocated before the CRC is checked
+		length := int64(binary.BigEndian.Uint32(header[0:]))
+		if length < 24 || length > remaining {
+			return items, errWALCorrupted
+		}
+		remaining -= length
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return items, errWALCorrupted
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return items, errWALCorrupted
+		}
+		keylen := binary.BigEndian.Uint32(payload[20:])
+		deleted := keylen&walDeleted != 0
+		keylen &^= walDeleted
+		if uint64(keylen) > uint64(len(payload)-24) {
+			return items, errWALCorrupted
+		}
+
+		item := CassandraSet{
+			seq:      binary.BigEndian.Uint64(payload[0:]),
+			Flags:    binary.BigEndian.Uint32(payload[16:]),
+			Key:      payload[24 : 24+keylen],
+			Data:     payload[24+keylen:],
+			Deleted:  deleted,
+			buffered: now,
+		}
+		if expires := int64(binary.BigEndian.Uint64(payload[8:])); expires > 0 {
+			ttl := time.Unix(expires, 0).Sub(now)
+			if ttl <= 0 {
+				continue
+			}
+			item.Exptime = uint32((ttl + time.Second - 1) / time.Second)
+		}
+		items = append(items, item)
+	}
+}
@@ -0,0 +1,132 @@
+package cassandra
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memandra")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, old, err := openWAL(dir, walSyncAlways, 1024, time.Second)
+	if err != nil {
+		t.Fatalf("Unable to open WAL: %v", err)
+	}
+	if len(old) != 0 {
+		t.Fatalf("Expected no segment to replay, got %v", old)
+	}
+
+	now := time.Now()
+	items := []CassandraSet{
+		{Key: []byte("key1"), Data: []byte("foo"), Flags: 42, Exptime: 60, seq: 1, buffered: now},
+		{Key: []byte("key2"), Data: []byte("bar"), seq: 2, buffered: now},
+		{Key: []byte("key3"), Data: []byte("expired"), Exptime: 1, seq: 3, buffered: now.Add(-time.Minute)},
+	}
+	for i := range items {
+		if err := w.append(&items[i]); err != nil {
+			t.Fatalf("Unable to append to WAL: %v", err)
+		}
+		if items[i].walseg != 1 {
+			t.Fatalf("Expected item to be logged in segment 1, got %d", items[i].walseg)
+		}
+	}
+
+	t.Run("Read", func(t *testing.T) {
+		read, err := readWALSegment(walSegmentPath(dir, 1), now)
+		if err != nil {
+			t.Fatalf("Unable to read WAL segment: %v", err)
+		}
+		if len(read) != 2 {
+			t.Fatalf("Expected 2 unexpired items, got %d", len(read))
+		}
+		if string(read[0].Key) != "key1" || string(read[0].Data) != "foo" || read[0].Flags != 42 || read[0].seq != 1 {
+			t.Fatalf("Unexpected item %#v", read[0])
+		}
+		if read[0].Exptime < 59 || read[0].Exptime > 60 {
+			t.Fatalf("Expected remaining TTL close to 60s, got %d", read[0].Exptime)
+		}
+		if string(read[1].Key) != "key2" || read[1].Exptime != 0 {
+			t.Fatalf("Unexpected item %#v", read[1])
+		}
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		f, err := os.OpenFile(walSegmentPath(dir, 1), os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatalf("Unable to open WAL segment: %v", err)
+		}
+		f.Write([]byte{0, 0, 0, 42, 1, 2})
+		f.Close()
+
+		read, err := readWALSegment(walSegmentPath(dir, 1), now)
+		if err != errWALCorrupted {
+			t.Fatalf("Expected a corrupted segment, got %v", err)
+		}
+		if len(read) != 2 {
+			t.Fatalf("Expected records before the corrupted one to be read, got %d", len(read))
+		}
+	})
+
+	t.Run("Release", func(t *testing.T) {
+		// Filling the active segment starts a new one
+		big := CassandraSet{Key: []byte("big"), Data: make([]byte, 1024), seq: 4, buffered: now}
+		if err := w.append(&big); err != nil {
+			t.Fatalf("Unable to append to WAL: %v", err)
+		}
+		if w.activeID != 2 {
+			t.Fatalf("Expected WAL to rotate to segment 2, got %d", w.activeID)
+		}
+
+		for _, item := range append(items, big) {
+			w.release(item)
+		}
+		if _, err := os.Stat(walSegmentPath(dir, 1)); !os.IsNotExist(err) {
+			t.Fatalf("Expected fully released segment to be removed")
+		}
+
+		_, old, err := openWAL(dir, walSyncNever, 1024, time.Second)
+		if err != nil {
+			t.Fatalf("Unable to reopen WAL: %v", err)
+		}
+		if len(old) != 1 || old[0] != 2 {
+			t.Fatalf("Expected active segment 2 to be left for replay, got %v", old)
+		}
+	})
+	t.Run("Deleted", func(t *testing.T) {
+		path := walSegmentPath(dir, 42)
+		record := encodeWALRecord(CassandraSet{Key: []byte("gone"), Deleted: true, seq: 5, buffered: now})
+		if err := ioutil.WriteFile(path, record, 0600); err != nil {
+			t.Fatalf("Unable to write WAL segment: %v", err)
+		}
+
+		read, err := readWALSegment(path, now)
+		if err != nil {
+			t.Fatalf("Unable to read WAL segment: %v", err)
+		}
+		if len(read) != 1 || !read[0].Deleted || string(read[0].Key) != "gone" || len(read[0].Data) != 0 || read[0].seq != 5 {
+			t.Fatalf("Expected a buffered deletion of 'gone', got %#v", read)
+		}
+	})
+	t.Run("CorruptedLength", func(t *testing.T) {
+		path := walSegmentPath(dir, 43)
+		record := encodeWALRecord(CassandraSet{Key: []byte("key"), Data: []byte("foo"), seq: 6, buffered: now})
+		huge := []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1, 2, 3}
+		if err := ioutil.WriteFile(path, append(record, huge...), 0600); err != nil {
+			t.Fatalf("Unable to write WAL segment: %v", err)
+		}
+
+		read, err := readWALSegment(path, now)
+		if err != errWALCorrupted {
+			t.Fatalf("Expected a record longer than the segment to be corrupted, got %v", err)
+		}
+		if len(read) != 1 || string(read[0].Key) != "key" {
+			t.Fatalf("Expected the record before the corrupted one to be read, got %#v", read)
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/server"
+)
+
+// drainListener is a TCP listener which can be closed on shutdown, so no new connection is accepted
+// while the handler drains. Rend's accept loop can't be stopped and panics on accept errors,
+// so once closed Accept blocks forever instead of returning an error.
+type drainListener struct {
+	listener  net.Listener
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newDrainListener(port int) (*drainListener, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("Error binding to port %d: %v", port, err.Error())
+	}
+	return &drainListener{
+		listener: listener,
+		closed:   make(chan struct{}),
+	}, nil
+}
+
+// listen is the ListenConst handing the listener to rend
+func (l *drainListener) listen() (server.Listener, error) {
+	return l, nil
+}
+
+func (l *drainListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.listener.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		select {
+		case <-l.closed:
+			select {}
+		default:
+		}
+		log.Println("[ERROR] Error accepting connection from remote:", err)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (l *drainListener) Configure(conn net.Conn) (net.Conn, error) {
+	tcpRemote := conn.(*net.TCPConn)
+
+	if err := tcpRemote.SetKeepAlive(true); err != nil {
+		return conn, err
+	}
+
+	if err := tcpRemote.SetKeepAlivePeriod(30 * time.Second); err != nil {
+		return conn, err
+	}
+
+	return conn, nil
+}
+
+// Close stops accepting connections, the connections already accepted are left open
+func (l *drainListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.listener.Close()
+	})
+	return err
+}
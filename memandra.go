@@ -23,30 +23,76 @@ func init_default_config() {
 	log.Println("Initializing configuration")
 	viper.SetDefault("ListenPort", 11221)
 	viper.SetDefault("InternalMetricsListenAddress", ":11299")
+	viper.SetDefault("DrainTimeoutMs", 10000*time.Millisecond)
 	viper.SetDefault("CassandraHostname", "127.0.0.1")
 	viper.SetDefault("CassandraKeyspace", "kvstore")
 	viper.SetDefault("CassandraBucket", "bucket")
 	viper.SetDefault("CassandraBatchBufferItemSize", 80000)
 	viper.SetDefault("CassandraBatchBufferMaxAgeMs", 200*time.Millisecond)
+	viper.SetDefault("CassandraBatchBufferTimeoutMs", 0)
+	viper.SetDefault("CassandraBatchBufferShedPercent", 0)
 	viper.SetDefault("CassandraBatchMinItemSize", 1000)
 	viper.SetDefault("CassandraBatchMaxItemSize", 5000)
+	viper.SetDefault("CassandraBatchMaxBytes", 50*1024)
 	viper.SetDefault("CassandraTimeoutMs", 1000*time.Millisecond)
 	viper.SetDefault("CassandraConnectTimeoutMs", 1000*time.Millisecond)
+	viper.SetDefault("CassandraLWTReplace", true)
+	viper.SetDefault("CassandraLWTDelete", false)
+	viper.SetDefault("CassandraBufferedDeletes", false)
+	viper.SetDefault("CassandraGetConcurrency", 16)
+	viper.SetDefault("CassandraGetErrorMode", "error")
+	viper.SetDefault("CassandraSyncWrites", false)
+	viper.SetDefault("CassandraBatchWriters", 4)
+	viper.SetDefault("CassandraBatchQueueSize", 4)
+	viper.SetDefault("CassandraTokenAwareBatches", true)
+	viper.SetDefault("CassandraBatchRetries", 3)
+	viper.SetDefault("CassandraBatchRetryBackoffMs", 50*time.Millisecond)
+	viper.SetDefault("CassandraDeadLetterFile", "")
+	viper.SetDefault("CassandraSpillDir", "")
+	viper.SetDefault("CassandraSpillMaxBytes", 1024*1024*1024)
+	viper.SetDefault("CassandraSpillReplayIntervalMs", 1000*time.Millisecond)
+	viper.SetDefault("CassandraWALDir", "")
+	viper.SetDefault("CassandraWALSync", "interval")
+	viper.SetDefault("CassandraWALSyncIntervalMs", 100*time.Millisecond)
+	viper.SetDefault("CassandraWALSegmentSize", 64*1024*1024)
 }
 
 func load_config_from_env() {
 	log.Println("Mapping configuration from environment")
 	viper.BindEnv("ListenPort", "LISTENPORT")
 	viper.BindEnv("InternalMetricsListenAddress", "METRICSLISTENADDR")
+	viper.BindEnv("DrainTimeoutMs", "DRAINTIMEOUT")
 	viper.BindEnv("CassandraHostname", "CASSANDRAHOST")
 	viper.BindEnv("CassandraKeyspace", "CASSANDRAKEYSPACE")
 	viper.BindEnv("CassandraBucket", "CASSANDRABUCKET")
 	viper.BindEnv("CassandraBatchBufferItemSize", "BUFFERITEMSIZE")
 	viper.BindEnv("CassandraBatchBufferMaxAgeMs", "BUFFERMAXAGE")
+	viper.BindEnv("CassandraBatchBufferTimeoutMs", "BUFFERTIMEOUT")
+	viper.BindEnv("CassandraBatchBufferShedPercent", "BUFFERSHEDPERCENT")
 	viper.BindEnv("CassandraBatchMinItemSize", "BATCHMINSIZE")
 	viper.BindEnv("CassandraBatchMaxItemSize", "BATCHMAXSIZE")
+	viper.BindEnv("CassandraBatchMaxBytes", "BATCHMAXBYTES")
 	viper.BindEnv("CassandraTimeoutMs", "CASSANDRATIMEOUT")
 	viper.BindEnv("CassandraConnectTimeoutMs", "CASSANDRACONNTIMEOUT")
+	viper.BindEnv("CassandraLWTReplace", "LWTREPLACE")
+	viper.BindEnv("CassandraLWTDelete", "LWTDELETE")
+	viper.BindEnv("CassandraBufferedDeletes", "BUFFEREDDELETES")
+	viper.BindEnv("CassandraGetConcurrency", "GETCONCURRENCY")
+	viper.BindEnv("CassandraGetErrorMode", "GETERRORMODE")
+	viper.BindEnv("CassandraSyncWrites", "SYNCWRITES")
+	viper.BindEnv("CassandraBatchWriters", "BATCHWRITERS")
+	viper.BindEnv("CassandraBatchQueueSize", "BATCHQUEUESIZE")
+	viper.BindEnv("CassandraTokenAwareBatches", "TOKENAWAREBATCHES")
+	viper.BindEnv("CassandraBatchRetries", "BATCHRETRIES")
+	viper.BindEnv("CassandraBatchRetryBackoffMs", "BATCHRETRYBACKOFF")
+	viper.BindEnv("CassandraDeadLetterFile", "DEADLETTERFILE")
+	viper.BindEnv("CassandraSpillDir", "SPILLDIR")
+	viper.BindEnv("CassandraSpillMaxBytes", "SPILLMAXBYTES")
+	viper.BindEnv("CassandraSpillReplayIntervalMs", "SPILLREPLAYINTERVAL")
+	viper.BindEnv("CassandraWALDir", "WALDIR")
+	viper.BindEnv("CassandraWALSync", "WALSYNC")
+	viper.BindEnv("CassandraWALSyncIntervalMs", "WALSYNCINTERVAL")
+	viper.BindEnv("CassandraWALSegmentSize", "WALSEGMENTSIZE")
 }
 
 func main() {
@@ -75,24 +121,26 @@ func main() {
 		log.Fatal(err)
 	}
 
-	l := server.TCPListener(viper.GetInt("ListenPort"))
+	l, err := newDrainListener(viper.GetInt("ListenPort"))
+	if err != nil {
+		log.Fatal(err)
+	}
 	ps := []protocol.Components{binprot.Components, textprot.Components}
 
 	// Graceful stop
-	var gracefulStop = make(chan os.Signal)
+	var gracefulStop = make(chan os.Signal, 1)
 	signal.Notify(gracefulStop, syscall.SIGTERM)
-	signal.Notify(gracefulStop, syscall.SIGKILL)
 	signal.Notify(gracefulStop, syscall.SIGINT)
 	go func() {
-		_ = <-gracefulStop
+		<-gracefulStop
 		log.Println("[INFO] Gracefully stopping Memandra server")
+		log.Println("[INFO] Closing listener, new connections are refused")
+		l.Close()
 		log.Println("[INFO] Setting Cassandra handler to readonly mode")
 		cassandra.SetReadonlyMode()
-		time.Sleep(500 * time.Millisecond)
-		log.Println("[INFO] Forcing write buffer to be flushed before exiting")
-		cassandra.FlushBuffer()
+		cassandra.Drain(viper.GetDuration("DrainTimeoutMs"))
 		os.Exit(0)
 	}()
 
-	server.ListenAndServe(l, ps, server.Default, orcas.L1OnlyCassandra, h1, h2)
+	server.ListenAndServe(l.listen, ps, server.Default, orcas.L1OnlyCassandra, h1, h2)
 }
@@ -15,8 +15,6 @@
 package orcas
 
 import (
-	"log"
-
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/metrics"
@@ -62,17 +60,40 @@ func (l *L1OnlyCassandraOrca) Set(req common.SetRequest) error {
 }
 
 func (l *L1OnlyCassandraOrca) Add(req common.SetRequest) error {
-	// Add is not yet implemented.
-	log.Println("[WARN] Add command not supported by L1Only Cassandra orchestrator")
-	return common.ErrUnknownCmd
+	//log.Println("add", string(req.Key))
+
+	metrics.IncCounter(orcas.MetricCmdAddL1)
+	start := timer.Now()
+
+	err := l.l1.Add(req)
+
+	metrics.ObserveHist(orcas.HistAddL1, timer.Since(start))
+
+	if err == nil {
+		metrics.IncCounter(orcas.MetricCmdAddStoredL1)
+		metrics.IncCounter(orcas.MetricCmdAddStored)
+
+		err = l.res.Add(req.Opaque, req.Quiet)
+
+	} else if err == common.ErrKeyExists {
+		// Adding a key that already exists is a normal error,
+		// memcached return a NOT_STORED msg in this case
+		metrics.IncCounter(orcas.MetricCmdAddNotStoredL1)
+		metrics.IncCounter(orcas.MetricCmdAddNotStored)
+	} else {
+		metrics.IncCounter(orcas.MetricCmdAddErrorsL1)
+		metrics.IncCounter(orcas.MetricCmdAddErrors)
+	}
+
+	return err
 }
 
 func (l *L1OnlyCassandraOrca) Replace(req common.SetRequest) error {
 	//log.Println("replace", string(req.Key))
 
 	// Replace in L1 (SLOW PATH) :
-	// We need to ask L1 if the key exists before setting the key or not (it's slower)
-	metrics.IncCounter(orcas.MetricCmdReplaceL2)
+	// L1 only stores the key if it already exists (it's slower than a set)
+	metrics.IncCounter(orcas.MetricCmdReplaceL1)
 	start := timer.Now()
 	err := l.l1.Replace(req)
 	metrics.ObserveHist(orcas.HistReplaceL1, timer.Since(start))
@@ -95,15 +116,61 @@ func (l *L1OnlyCassandraOrca) Replace(req common.SetRequest) error {
 }
 
 func (l *L1OnlyCassandraOrca) Append(req common.SetRequest) error {
-	// Append is not yet implemented.
-	log.Println("[WARN] Append command not supported by L1Only Cassandra orchestrator")
-	return common.ErrUnknownCmd
+	//log.Println("append", string(req.Key))
+
+	metrics.IncCounter(orcas.MetricCmdAppendL1)
+	start := timer.Now()
+
+	err := l.l1.Append(req)
+
+	metrics.ObserveHist(orcas.HistAppendL1, timer.Since(start))
+
+	if err == nil {
+		metrics.IncCounter(orcas.MetricCmdAppendStoredL1)
+		metrics.IncCounter(orcas.MetricCmdAppendStored)
+
+		err = l.res.Append(req.Opaque, req.Quiet)
+
+	} else if err == common.ErrKeyNotFound {
+		// Appending to a key that doesn't exist is a normal error
+		metrics.IncCounter(orcas.MetricCmdAppendNotStoredL1)
+		metrics.IncCounter(orcas.MetricCmdAppendNotStored)
+		err = common.ErrItemNotStored // memcached return a NOT_STORED msg in this case
+	} else {
+		metrics.IncCounter(orcas.MetricCmdAppendErrorsL1)
+		metrics.IncCounter(orcas.MetricCmdAppendErrors)
+	}
+
+	return err
 }
 
 func (l *L1OnlyCassandraOrca) Prepend(req common.SetRequest) error {
-	// Prepend is not yet implemented.
-	log.Println("[WARN] Prepend command not supported by L1Only Cassandra orchestrator")
-	return common.ErrUnknownCmd
+	//log.Println("prepend", string(req.Key))
+
+	metrics.IncCounter(orcas.MetricCmdPrependL1)
+	start := timer.Now()
+
+	err := l.l1.Prepend(req)
+
+	metrics.ObserveHist(orcas.HistPrependL1, timer.Since(start))
+
+	if err == nil {
+		metrics.IncCounter(orcas.MetricCmdPrependStoredL1)
+		metrics.IncCounter(orcas.MetricCmdPrependStored)
+
+		err = l.res.Prepend(req.Opaque, req.Quiet)
+
+	} else if err == common.ErrKeyNotFound {
+		// Prepending to a key that doesn't exist is a normal error
+		metrics.IncCounter(orcas.MetricCmdPrependNotStoredL1)
+		metrics.IncCounter(orcas.MetricCmdPrependNotStored)
+		err = common.ErrItemNotStored // memcached return a NOT_STORED msg in this case
+	} else {
+		metrics.IncCounter(orcas.MetricCmdPrependErrorsL1)
+		metrics.IncCounter(orcas.MetricCmdPrependErrors)
+	}
+
+	return err
 }
 
 func (l *L1OnlyCassandraOrca) Delete(req common.DeleteRequest) error {
@@ -134,9 +201,30 @@ func (l *L1OnlyCassandraOrca) Delete(req common.DeleteRequest) error {
 }
 
 func (l *L1OnlyCassandraOrca) Touch(req common.TouchRequest) error {
-	// Touch is not yet implemented.
-	log.Println("[WARN] Touch command not supported by L1Only Cassandra orchestrator")
-	return common.ErrUnknownCmd
+	//log.Println("touch", string(req.Key))
+
+	metrics.IncCounter(orcas.MetricCmdTouchL1)
+	start := timer.Now()
+
+	err := l.l1.Touch(req)
+
+	metrics.ObserveHist(orcas.HistTouchL1, timer.Since(start))
+
+	if err == nil {
+		metrics.IncCounter(orcas.MetricCmdTouchHitsL1)
+		metrics.IncCounter(orcas.MetricCmdTouchHits)
+
+		l.res.Touch(req.Opaque)
+
+	} else if err == common.ErrKeyNotFound {
+		metrics.IncCounter(orcas.MetricCmdTouchMissesL1)
+		metrics.IncCounter(orcas.MetricCmdTouchMisses)
+	} else {
+		metrics.IncCounter(orcas.MetricCmdTouchErrorsL1)
+		metrics.IncCounter(orcas.MetricCmdTouchErrors)
+	}
+
+	return err
 }
 
 func (l *L1OnlyCassandraOrca) Get(req common.GetRequest) error {
@@ -202,15 +290,89 @@ func (l *L1OnlyCassandraOrca) Get(req common.GetRequest) error {
 }
 
 func (l *L1OnlyCassandraOrca) GetE(req common.GetRequest) error {
-	// The L1OnlyCassandra orca does not support getE, only L1L2 does (see the old l1l2 branch).
-	log.Println("[WARN] Use of unsupported GetE in L1Only Cassandra orchestrator")
-	return common.ErrUnknownCmd
+	// GetE is a binary protocol extension returning the remaining TTL of each key,
+	// the Cassandra handler reads it from the TTL of the value column.
+	metrics.IncCounterBy(orcas.MetricCmdGetEKeys, uint64(len(req.Keys)))
+
+	metrics.IncCounter(orcas.MetricCmdGetEL1)
+	metrics.IncCounterBy(orcas.MetricCmdGetEKeysL1, uint64(len(req.Keys)))
+	start := timer.Now()
+
+	resChan, errChan := l.l1.GetE(req)
+
+	var err error
+
+	// Read all the responses back from l.l1.
+	// The contract is that the resChan will have GetEResponse's for get hits and misses,
+	// and the errChan will have any other errors, such as a Cassandra timeout.
+	// If any receive happens from errChan, there will be no more responses from resChan.
+	for {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				if res.Miss {
+					metrics.IncCounter(orcas.MetricCmdGetEMissesL1)
+					metrics.IncCounter(orcas.MetricCmdGetEMisses)
+				} else {
+					metrics.IncCounter(orcas.MetricCmdGetEHits)
+					metrics.IncCounter(orcas.MetricCmdGetEHitsL1)
+				}
+				l.res.GetE(res)
+			}
+
+		case getErr, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				metrics.IncCounter(orcas.MetricCmdGetEErrors)
+				metrics.IncCounter(orcas.MetricCmdGetEErrorsL1)
+				err = getErr
+			}
+		}
+
+		if resChan == nil && errChan == nil {
+			break
+		}
+	}
+
+	metrics.ObserveHist(orcas.HistGetEL1, timer.Since(start))
+
+	if err == nil {
+		l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+	}
+
+	return err
 }
 
 func (l *L1OnlyCassandraOrca) Gat(req common.GATRequest) error {
-	// Get and Touch is not yet implemented.
-	log.Println("[WARN] Get & Touch (GAT) command not supported by L1Only Cassandra orchestrator")
-	return common.ErrUnknownCmd
+	//log.Println("gat", string(req.Key))
+
+	metrics.IncCounter(orcas.MetricCmdGatL1)
+	start := timer.Now()
+
+	res, err := l.l1.GAT(req)
+
+	metrics.ObserveHist(orcas.HistGatL1, timer.Since(start))
+
+	if err == nil {
+		if res.Miss {
+			metrics.IncCounter(orcas.MetricCmdGatMissesL1)
+			metrics.IncCounter(orcas.MetricCmdGatMisses)
+		} else {
+			metrics.IncCounter(orcas.MetricCmdGatHits)
+			metrics.IncCounter(orcas.MetricCmdGatHitsL1)
+		}
+		// GAT only exists in the binary protocol, where there's no END marker.
+		// No GetEnd call is required here.
+		l.res.GAT(res)
+	} else {
+		metrics.IncCounter(orcas.MetricCmdGatErrors)
+		metrics.IncCounter(orcas.MetricCmdGatErrorsL1)
+	}
+
+	return err
 }
 
 func (l *L1OnlyCassandraOrca) Noop(req common.NoopRequest) error {
@@ -17,11 +17,13 @@ package orcas_test
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"testing"
 
 	"github.com/BarthV/memandra/orcas"
 	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/protocol/binprot"
 	"github.com/netflix/rend/protocol/textprot"
 )
 
@@ -345,161 +347,601 @@ func TestL1OnlyCassandraOrca(t *testing.T) {
 		})
 	})
 
-	// MISC & UNSUPPORTED COMMANDS
+	t.Run("Add", func(t *testing.T) {
+		// ADD -> L1 OK
+		t.Run("L1AddSuccess", func(t *testing.T) {
+			h1 := &testHandler{
+				errors: []error{nil},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
+
+			l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			err := l1only.Add(common.SetRequest{
+				Key:    []byte("key"),
+				Data:   []byte("value"),
+				Opaque: 0,
+				Quiet:  false,
+			})
+			if err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+
+			out := string(output.Bytes())
+
+			t.Logf(out)
+			gold := "STORED\r\n"
+
+			if out != gold {
+				t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
+
+		// ADD -> L1 KEY EXISTS
+		t.Run("L1AddExists", func(t *testing.T) {
+			h1 := &testHandler{
+				errors: []error{common.ErrKeyExists},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
+
+			l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			err := l1only.Add(common.SetRequest{
+				Key:    []byte("key"),
+				Data:   []byte("value"),
+				Opaque: 0,
+				Quiet:  false,
+			})
+			if err != common.ErrKeyExists {
+				t.Fatalf("Error should be %s, got %v", common.ErrKeyExists, err)
+			}
+
+			out := string(output.Bytes())
+
+			if out != "" {
+				t.Fatalf("Expected response is nil but got '%v'", out)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
+
+		// ADD -> L1 Error
+		t.Run("L1AddFailure", func(t *testing.T) {
+			h1 := &testHandler{
+				errors: []error{common.ErrInternal},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
+
+			l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			err := l1only.Add(common.SetRequest{
+				Key:    []byte("key"),
+				Data:   []byte("value"),
+				Opaque: 0,
+				Quiet:  false,
+			})
+			if err != common.ErrInternal {
+				t.Fatalf("Error should be %s, got %v", common.ErrInternal, err)
+			}
+
+			out := string(output.Bytes())
+
+			if out != "" {
+				t.Fatalf("Expected response is nil but got '%v'", out)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
+	})
+
+	t.Run("Append", func(t *testing.T) {
+		// APPEND -> L1 OK
+		t.Run("L1AppendSuccess", func(t *testing.T) {
+			h1 := &testHandler{
+				errors: []error{nil},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
+
+			l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			err := l1only.Append(common.SetRequest{
+				Key:    []byte("key"),
+				Data:   []byte("value"),
+				Opaque: 0,
+				Quiet:  false,
+			})
+			if err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+
+			out := string(output.Bytes())
+
+			t.Logf(out)
+			gold := "STORED\r\n"
+
+			if out != gold {
+				t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
+
+		// APPEND -> L1 MISS
+		t.Run("L1AppendNotFound", func(t *testing.T) {
+			h1 := &testHandler{
+				errors: []error{common.ErrKeyNotFound},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
+
+			l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			err := l1only.Append(common.SetRequest{
+				Key:    []byte("key"),
+				Data:   []byte("value"),
+				Opaque: 0,
+				Quiet:  false,
+			})
+			if err != common.ErrItemNotStored {
+				t.Fatalf("Error should be %s, got %v", common.ErrItemNotStored, err)
+			}
+
+			out := string(output.Bytes())
+
+			if out != "" {
+				t.Fatalf("Expected response is nil but got '%v'", out)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
+
+		// APPEND -> L1 Error
+		t.Run("L1AppendFailure", func(t *testing.T) {
+			h1 := &testHandler{
+				errors: []error{common.ErrInternal},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
+
+			l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			err := l1only.Append(common.SetRequest{
+				Key:    []byte("key"),
+				Data:   []byte("value"),
+				Opaque: 0,
+				Quiet:  false,
+			})
+			if err != common.ErrInternal {
+				t.Fatalf("Error should be %s, got %v", common.ErrInternal, err)
+			}
+
+			out := string(output.Bytes())
+
+			if out != "" {
+				t.Fatalf("Expected response is nil but got '%v'", out)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
+	})
+
+	t.Run("Prepend", func(t *testing.T) {
+		// PREPEND -> L1 OK
+		t.Run("L1PrependSuccess", func(t *testing.T) {
+			h1 := &testHandler{
+				errors: []error{nil},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
+
+			l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			err := l1only.Prepend(common.SetRequest{
+				Key:    []byte("key"),
+				Data:   []byte("value"),
+				Opaque: 0,
+				Quiet:  false,
+			})
+			if err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+
+			out := string(output.Bytes())
+
+			t.Logf(out)
+			gold := "STORED\r\n"
+
+			if out != gold {
+				t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
+
+		// PREPEND -> L1 MISS
+		t.Run("L1PrependNotFound", func(t *testing.T) {
+			h1 := &testHandler{
+				errors: []error{common.ErrKeyNotFound},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
+
+			l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			err := l1only.Prepend(common.SetRequest{
+				Key:    []byte("key"),
+				Data:   []byte("value"),
+				Opaque: 0,
+				Quiet:  false,
+			})
+			if err != common.ErrItemNotStored {
+				t.Fatalf("Error should be %s, got %v", common.ErrItemNotStored, err)
+			}
+
+			out := string(output.Bytes())
+
+			if out != "" {
+				t.Fatalf("Expected response is nil but got '%v'", out)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
+
+		// PREPEND -> L1 Error
+		t.Run("L1PrependFailure", func(t *testing.T) {
+			h1 := &testHandler{
+				errors: []error{common.ErrInternal},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
+
+			l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			err := l1only.Prepend(common.SetRequest{
+				Key:    []byte("key"),
+				Data:   []byte("value"),
+				Opaque: 0,
+				Quiet:  false,
+			})
+			if err != common.ErrInternal {
+				t.Fatalf("Error should be %s, got %v", common.ErrInternal, err)
+			}
+
+			out := string(output.Bytes())
+
+			if out != "" {
+				t.Fatalf("Expected response is nil but got '%v'", out)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
+	})
+
 	t.Run("Touch", func(t *testing.T) {
-		h1 := &testHandler{}
-		h2 := &testHandler{}
-		output := &bytes.Buffer{}
-		l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+		// TOUCH -> L1 HIT
+		t.Run("L1TouchHit", func(t *testing.T) {
+			h1 := &testHandler{
+				errors: []error{nil},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
+
+			l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			err := l1only.Touch(common.TouchRequest{
+				Key:     []byte("key"),
+				Exptime: 60,
+				Opaque:  0,
+				Quiet:   false,
+			})
+			if err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
 
-		err := l1only.Touch(common.TouchRequest{})
-		if err != common.ErrUnknownCmd {
-			t.Fatalf("Error should be %s, got %v", common.ErrUnknownCmd, err)
-		}
+			out := string(output.Bytes())
 
-		out := string(output.Bytes())
-		gold := ""
+			t.Logf(out)
+			gold := "TOUCHED\r\n"
 
-		if out != gold {
-			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
-		}
+			if out != gold {
+				t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+			}
 
-		h1.verifyEmpty(t)
-		h2.verifyEmpty(t)
-	})
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
 
-	t.Run("Add", func(t *testing.T) {
-		h1 := &testHandler{}
-		h2 := &testHandler{}
-		output := &bytes.Buffer{}
-		l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+		// TOUCH -> L1 MISS
+		t.Run("L1TouchMiss", func(t *testing.T) {
+			h1 := &testHandler{
+				errors: []error{common.ErrKeyNotFound},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
 
-		err := l1only.Add(common.SetRequest{})
-		if err != common.ErrUnknownCmd {
-			t.Fatalf("Error should be %s, got %v", common.ErrUnknownCmd, err)
-		}
+			l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
 
-		out := string(output.Bytes())
-		gold := ""
+			err := l1only.Touch(common.TouchRequest{
+				Key:     []byte("key"),
+				Exptime: 60,
+				Opaque:  0,
+				Quiet:   false,
+			})
+			if err != common.ErrKeyNotFound {
+				t.Fatalf("Error should be %s, got %v", common.ErrKeyNotFound, err)
+			}
 
-		if out != gold {
-			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
-		}
+			out := string(output.Bytes())
 
-		h1.verifyEmpty(t)
-		h2.verifyEmpty(t)
-	})
+			if out != "" {
+				t.Fatalf("Expected response is nil but got '%v'", out)
+			}
 
-	t.Run("Add", func(t *testing.T) {
-		h1 := &testHandler{}
-		h2 := &testHandler{}
-		output := &bytes.Buffer{}
-		l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
 
-		err := l1only.Add(common.SetRequest{})
-		if err != common.ErrUnknownCmd {
-			t.Fatalf("Error should be %s, got %v", common.ErrUnknownCmd, err)
-		}
+		// TOUCH -> L1 Error
+		t.Run("L1TouchFailure", func(t *testing.T) {
+			h1 := &testHandler{
+				errors: []error{common.ErrInternal},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
 
-		out := string(output.Bytes())
-		gold := ""
+			l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
 
-		if out != gold {
-			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
-		}
+			err := l1only.Touch(common.TouchRequest{
+				Key:     []byte("key"),
+				Exptime: 60,
+				Opaque:  0,
+				Quiet:   false,
+			})
+			if err != common.ErrInternal {
+				t.Fatalf("Error should be %s, got %v", common.ErrInternal, err)
+			}
 
-		h1.verifyEmpty(t)
-		h2.verifyEmpty(t)
+			out := string(output.Bytes())
+
+			if out != "" {
+				t.Fatalf("Expected response is nil but got '%v'", out)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
 	})
 
-	t.Run("Append", func(t *testing.T) {
-		h1 := &testHandler{}
-		h2 := &testHandler{}
-		output := &bytes.Buffer{}
-		l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+	// GETE only exists in the binary protocol
+	t.Run("GetE", func(t *testing.T) {
+		// GETE -> L1 HIT
+		t.Run("L1Hit", func(t *testing.T) {
+			h1 := &testHandler{
+				eresponses: []common.GetEResponse{
+					{
+						Key:     []byte("key"),
+						Data:    []byte("foo"),
+						Exptime: 42,
+					},
+				},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
 
-		err := l1only.Append(common.SetRequest{})
-		if err != common.ErrUnknownCmd {
-			t.Fatalf("Error should be %s, got %v", common.ErrUnknownCmd, err)
-		}
+			l1only := orcas.L1OnlyCassandra(h1, h2, binprot.NewBinaryResponder(bufio.NewWriter(output)))
 
-		out := string(output.Bytes())
-		gold := ""
+			err := l1only.GetE(common.GetRequest{
+				Keys:    [][]byte{[]byte("key")},
+				Opaques: []uint32{0},
+				Quiet:   []bool{false},
+				NoopEnd: false,
+			})
+			if err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
 
-		if out != gold {
-			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
-		}
+			out := output.Bytes()
 
-		h1.verifyEmpty(t)
-		h2.verifyEmpty(t)
-	})
+			// 24 bytes header + 4 bytes flags + 4 bytes exptime + data
+			if len(out) != 35 || out[1] != binprot.OpcodeGetE || string(out[32:]) != "foo" {
+				t.Fatalf("Expected a GETE response holding 'foo' but got '%v'", out)
+			}
+			if exptime := binary.BigEndian.Uint32(out[28:32]); exptime != 42 {
+				t.Fatalf("Expected remaining TTL to be 42 but got %v", exptime)
+			}
 
-	t.Run("Prepend", func(t *testing.T) {
-		h1 := &testHandler{}
-		h2 := &testHandler{}
-		output := &bytes.Buffer{}
-		l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
 
-		err := l1only.Prepend(common.SetRequest{})
-		if err != common.ErrUnknownCmd {
-			t.Fatalf("Error should be %s, got %v", common.ErrUnknownCmd, err)
-		}
+		// GETE -> L1 MISS
+		t.Run("L1Miss", func(t *testing.T) {
+			h1 := &testHandler{
+				eresponses: []common.GetEResponse{
+					{
+						Key:  []byte("key"),
+						Miss: true,
+					},
+				},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
 
-		out := string(output.Bytes())
-		gold := ""
+			l1only := orcas.L1OnlyCassandra(h1, h2, binprot.NewBinaryResponder(bufio.NewWriter(output)))
 
-		if out != gold {
-			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
-		}
+			err := l1only.GetE(common.GetRequest{
+				Keys:    [][]byte{[]byte("key")},
+				Opaques: []uint32{0},
+				Quiet:   []bool{false},
+				NoopEnd: false,
+			})
+			if err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
 
-		h1.verifyEmpty(t)
-		h2.verifyEmpty(t)
-	})
+			out := output.Bytes()
 
-	t.Run("GetE", func(t *testing.T) {
-		h1 := &testHandler{}
-		h2 := &testHandler{}
-		output := &bytes.Buffer{}
-		l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+			// 24 bytes header only, with a "key not found" status
+			if len(out) != 24 || out[1] != binprot.OpcodeGetE || out[7] != byte(binprot.StatusKeyEnoent) {
+				t.Fatalf("Expected a GETE key not found response but got '%v'", out)
+			}
 
-		err := l1only.GetE(common.GetRequest{})
-		if err != common.ErrUnknownCmd {
-			t.Fatalf("Error should be %s, got %v", common.ErrUnknownCmd, err)
-		}
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
 
-		out := string(output.Bytes())
-		gold := ""
+		// GETE -> L1 Error
+		t.Run("L1Failure", func(t *testing.T) {
+			h1 := &testHandler{
+				errors: []error{common.ErrInternal},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
 
-		if out != gold {
-			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
-		}
+			l1only := orcas.L1OnlyCassandra(h1, h2, binprot.NewBinaryResponder(bufio.NewWriter(output)))
 
-		h1.verifyEmpty(t)
-		h2.verifyEmpty(t)
+			err := l1only.GetE(common.GetRequest{
+				Keys:    [][]byte{[]byte("key")},
+				Opaques: []uint32{0},
+				Quiet:   []bool{false},
+				NoopEnd: false,
+			})
+			if err != common.ErrInternal {
+				t.Fatalf("Error should be %s, got %v", common.ErrInternal, err)
+			}
+
+			out := output.Bytes()
+
+			if len(out) != 0 {
+				t.Fatalf("Expected response is nil but got '%v'", out)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
 	})
 
+	// GAT only exists in the binary protocol
 	t.Run("Gat", func(t *testing.T) {
-		h1 := &testHandler{}
-		h2 := &testHandler{}
-		output := &bytes.Buffer{}
-		l1only := orcas.L1OnlyCassandra(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+		// GAT -> L1 HIT
+		t.Run("L1Hit", func(t *testing.T) {
+			h1 := &testHandler{
+				responses: []common.GetResponse{
+					{
+						Key:  []byte("key"),
+						Data: []byte("foo"),
+					},
+				},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
 
-		err := l1only.Gat(common.GATRequest{})
-		if err != common.ErrUnknownCmd {
-			t.Fatalf("Error should be %s, got %v", common.ErrUnknownCmd, err)
-		}
+			l1only := orcas.L1OnlyCassandra(h1, h2, binprot.NewBinaryResponder(bufio.NewWriter(output)))
 
-		out := string(output.Bytes())
-		gold := ""
+			err := l1only.Gat(common.GATRequest{
+				Key:     []byte("key"),
+				Exptime: 60,
+				Opaque:  0,
+				Quiet:   false,
+			})
+			if err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
 
-		if out != gold {
-			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
-		}
+			out := output.Bytes()
 
-		h1.verifyEmpty(t)
-		h2.verifyEmpty(t)
+			// 24 bytes header + 4 bytes flags + data
+			if len(out) != 31 || out[1] != binprot.OpcodeGat || string(out[28:]) != "foo" {
+				t.Fatalf("Expected a GAT response holding 'foo' but got '%v'", out)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
+
+		// GAT -> L1 MISS
+		t.Run("L1Miss", func(t *testing.T) {
+			h1 := &testHandler{
+				responses: []common.GetResponse{
+					{
+						Key:  []byte("key"),
+						Miss: true,
+					},
+				},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
+
+			l1only := orcas.L1OnlyCassandra(h1, h2, binprot.NewBinaryResponder(bufio.NewWriter(output)))
+
+			err := l1only.Gat(common.GATRequest{
+				Key:     []byte("key"),
+				Exptime: 60,
+				Opaque:  0,
+				Quiet:   false,
+			})
+			if err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+
+			out := output.Bytes()
+
+			// 24 bytes header only, with a "key not found" status
+			if len(out) != 24 || out[1] != binprot.OpcodeGat || out[7] != byte(binprot.StatusKeyEnoent) {
+				t.Fatalf("Expected a GAT key not found response but got '%v'", out)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
+
+		// GAT -> L1 Error
+		t.Run("L1Failure", func(t *testing.T) {
+			h1 := &testHandler{
+				errors: []error{common.ErrInternal},
+			}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
+
+			l1only := orcas.L1OnlyCassandra(h1, h2, binprot.NewBinaryResponder(bufio.NewWriter(output)))
+
+			err := l1only.Gat(common.GATRequest{
+				Key:     []byte("key"),
+				Exptime: 60,
+				Opaque:  0,
+				Quiet:   false,
+			})
+			if err != common.ErrInternal {
+				t.Fatalf("Error should be %s, got %v", common.ErrInternal, err)
+			}
+
+			out := output.Bytes()
+
+			if len(out) != 0 {
+				t.Fatalf("Expected response is nil but got '%v'", out)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
 	})
 
+	// MISC COMMANDS
 	t.Run("Noop", func(t *testing.T) {
 		h1 := &testHandler{}
 		h2 := &testHandler{}
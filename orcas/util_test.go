@@ -114,6 +114,12 @@ func (h *testHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <
 	return reschan, errchan
 }
 func (h *testHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	if len(h.responses) > 0 {
+		res := h.responses[0]
+		h.responses = h.responses[1:]
+		return res, nil
+	}
+
 	ret := h.errors[0]
 	h.errors = h.errors[1:]
 	return common.GetResponse{}, ret